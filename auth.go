@@ -51,6 +51,26 @@ type AuthOptions struct {
 	KeyID uint16
 }
 
+// PreparedAuth contains symmetric key authentication settings whose key has
+// already been decoded and validated. Preparing authentication settings
+// once avoids decoding the key on every query and surfaces key errors when
+// the settings are prepared rather than when a query is issued. A
+// PreparedAuth is immutable and may be shared by concurrent queries.
+type PreparedAuth struct {
+	opt AuthOptions
+	key []byte
+}
+
+// PrepareAuth decodes and validates the key contained in the authentication
+// options and returns the prepared settings.
+func PrepareAuth(opt AuthOptions) (*PreparedAuth, error) {
+	key, err := decodeAuthKey(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedAuth{opt: opt, key: key}, nil
+}
+
 var algorithms = []struct {
 	MinKeySize int
 	MaxKeySize int
@@ -190,7 +210,9 @@ func decodeAuthKey(opt AuthOptions) (key []byte, err error) {
 		key = key[:a.MaxKeySize]
 	}
 
-	return key, nil
+	// Clip the key's capacity, so digest calculations that append to it
+	// never write into memory shared by concurrent queries.
+	return key[:len(key):len(key)], nil
 }
 
 func appendMAC(buf *bytes.Buffer, opt AuthOptions, key []byte) {
@@ -198,6 +220,12 @@ func appendMAC(buf *bytes.Buffer, opt AuthOptions, key []byte) {
 		return
 	}
 
+	// The MAC must begin on a 4-byte boundary, so pad any extension data
+	// preceding it. The padding is covered by the digest.
+	if n := buf.Len() % 4; n != 0 {
+		buf.Write(make([]byte, 4-n))
+	}
+
 	a := algorithms[opt.Type]
 	payload := buf.Bytes()
 	digest := a.CalcDigest(payload, key)
@@ -212,7 +240,6 @@ func verifyMAC(buf []byte, opt AuthOptions, key []byte) error {
 
 	// Validate that there are enough bytes at the end of the message to
 	// contain a MAC.
-	const headerSize = 48
 	a := algorithms[opt.Type]
 	macLen := 4 + a.DigestSize
 	remain := len(buf) - headerSize
@@ -8,8 +8,10 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -186,6 +188,174 @@ func TestOfflineAesCmac(t *testing.T) {
 	}
 }
 
+func TestOfflinePreparedAuth(t *testing.T) {
+	cases := []AuthOptions{
+		{AuthMD5, "ASCII:cvuZyN4C8HX8hNcAWDWp", 1},
+		{AuthSHA1, "HEX:6931564b4a5a5045766c55356b30656c7666316c", 2},
+		{AuthSHA256, "HEX:7133736e777057764256777739706a5533326164", 3},
+		{AuthSHA512, "HEX:597675555446585868494d447543425971526e74", 4},
+		{AuthAES128, "HEX:68663033736f77706568707164304049", 5},
+		{AuthAES256, "HEX:47cb76a9a507cf26dc00eb0935f082f390f10308c3e0d58716273a63259a758a", 6},
+	}
+
+	payload := make([]byte, 48)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for i, c := range cases {
+		p, err := PrepareAuth(c)
+		if err != nil {
+			t.Errorf("case %d: unexpected error [%v]\n", i, err)
+			continue
+		}
+
+		key, _ := decodeAuthKey(c)
+		inline := bytes.NewBuffer(append([]byte(nil), payload...))
+		appendMAC(inline, c, key)
+
+		prepared := bytes.NewBuffer(append([]byte(nil), payload...))
+		appendMAC(prepared, p.opt, p.key)
+
+		if !bytes.Equal(inline.Bytes(), prepared.Bytes()) {
+			t.Errorf("case %d: MACs do not match.\n", i)
+		}
+	}
+
+	_, err := PrepareAuth(AuthOptions{AuthMD5, "HEX:6376755a794e3443384858386", 1})
+	if err != ErrInvalidAuthKey {
+		t.Errorf("expected error [%v], got error [%v]\n", ErrInvalidAuthKey, err)
+	}
+}
+
+func TestOfflinePreparedAuthQuery(t *testing.T) {
+	auth := AuthOptions{AuthSHA1, "HEX:6931564b4a5a5045766c55356b30656c7666316c", 2}
+	p, err := PrepareAuth(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake server verifies the query's MAC and signs its reply with the
+	// same key.
+	key, _ := decodeAuthKey(auth)
+	opt := QueryOptions{
+		PreparedAuth: p,
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			if err := verifyMAC(q, auth, key); err != nil {
+				t.Errorf("query MAC not verified: %v\n", err)
+			}
+			reply := bytes.NewBuffer(makeReply(q, nil))
+			appendMAC(reply, auth, key)
+			return []datagram{{reply.Bytes(), addr}}
+		}),
+	}
+
+	// Issue concurrent queries sharing the prepared settings.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := QueryWithOptions("remote", opt)
+			if err != nil {
+				t.Errorf("unexpected error [%v]\n", err)
+				return
+			}
+			if err := r.Validate(); err != nil {
+				t.Errorf("unexpected validation error [%v]\n", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// rawExtension is an Extension that appends its bytes to each query.
+type rawExtension []byte
+
+func (e rawExtension) ProcessQuery(buf *bytes.Buffer) error {
+	buf.Write(e)
+	return nil
+}
+
+func (e rawExtension) ProcessResponse(buf []byte) error {
+	return nil
+}
+
+func TestOfflineMACAlignment(t *testing.T) {
+	auth := AuthOptions{AuthSHA256, "HEX:7133736e777057764256777739706a5533326164", 3}
+	key, _ := decodeAuthKey(auth)
+
+	for n := 0; n < 8; n++ {
+		buf := bytes.NewBuffer(make([]byte, headerSize+n))
+		appendMAC(buf, auth, key)
+		if (buf.Len()-headerSize)%4 != 0 {
+			t.Errorf("extension length %d: MAC not aligned\n", n)
+		}
+		if err := verifyMAC(buf.Bytes(), auth, key); err != nil {
+			t.Errorf("extension length %d: unexpected error [%v]\n", n, err)
+		}
+	}
+
+	// The fake server verifies the MAC following an extension of odd
+	// length.
+	opt := QueryOptions{
+		Auth:       auth,
+		Extensions: []Extension{rawExtension{1, 2, 3, 4, 5}},
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			if err := verifyMAC(q, auth, key); err != nil {
+				t.Errorf("query MAC not verified: %v\n", err)
+			}
+			reply := bytes.NewBuffer(makeReply(q, nil))
+			appendMAC(reply, auth, key)
+			return []datagram{{reply.Bytes(), addr}}
+		}),
+	}
+	if _, err := QueryWithOptions("remote", opt); err != nil {
+		t.Errorf("unexpected error [%v]\n", err)
+	}
+}
+
+func TestOfflineAuthValid(t *testing.T) {
+	auth := AuthOptions{AuthSHA1, "HEX:6931564b4a5a5045766c55356b30656c7666316c", 2}
+	key, _ := decodeAuthKey(auth)
+
+	cases := []struct {
+		auth    AuthOptions
+		corrupt bool
+		valid   bool
+		err     error
+	}{
+		{auth, false, true, nil},
+		{auth, true, false, ErrAuthFailed},
+		{AuthOptions{}, false, false, nil},
+	}
+
+	for i, c := range cases {
+		corrupt := c.corrupt
+		opt := QueryOptions{
+			Auth: c.auth,
+			Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+				reply := bytes.NewBuffer(makeReply(q, nil))
+				appendMAC(reply, auth, key)
+				b := reply.Bytes()
+				if corrupt {
+					b[len(b)-1] ^= 0xff
+				}
+				return []datagram{{b, addr}}
+			}),
+		}
+		r, err := QueryWithOptions("remote", opt)
+		if err != nil {
+			t.Errorf("case %d: unexpected error [%v]\n", i, err)
+			continue
+		}
+		valid, err := r.AuthValid()
+		if valid != c.valid || err != c.err {
+			t.Errorf("case %d: expected (%v, %v), got (%v, %v)\n", i, c.valid, c.err, valid, err)
+		}
+	}
+}
+
 func hexDecode(s string) []byte {
 	s = strings.ReplaceAll(s, " ", "")
 	b, err := hex.DecodeString(s)
@@ -0,0 +1,114 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Client queries a single NTP server repeatedly over a connection that
+// remains open between queries. It avoids the cost of creating a socket,
+// resolving the server's host name and decoding the authentication key for
+// every query, which may be significant for applications that query the
+// same server frequently. Each query carries its own random transmit time,
+// and replies that don't echo it, such as late replies to an earlier query
+// that timed out, are discarded. A Client is safe for concurrent use, but
+// its queries are issued one at a time.
+type Client struct {
+	address string
+	opt     QueryOptions
+
+	mu  sync.Mutex // serializes queries
+	con net.Conn
+}
+
+// NewClient creates a Client connected to the server at the given address
+// using the provided options. See QueryWithOptions for a description of
+// the address format. The host name is resolved once, when the connection
+// is made. The Warmup option is ignored. The Client should be closed when
+// it's no longer needed.
+func NewClient(address string, opt QueryOptions) (*Client, error) {
+	err := setDefaults(&opt)
+	if err != nil {
+		return nil, err
+	}
+	opt.Warmup = false
+
+	// Decode the authentication key once, rather than for every query.
+	if opt.PreparedAuth == nil && opt.Auth.Type != AuthNone {
+		opt.PreparedAuth, err = PrepareAuth(opt.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	con, err := dialServer(context.Background(), address, &opt)
+	if err != nil {
+		return nil, err
+	}
+	err = configureConn(con, &opt)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	return &Client{address: address, opt: opt, con: con}, nil
+}
+
+// Query queries the server over the Client's connection. It performs the
+// same function as QueryWithOptions, using the options provided to
+// NewClient.
+func (c *Client) Query() (*Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	opt := c.opt
+	q, err := c.exchange(&opt)
+	return finishQuery(c.address, &opt, q, err)
+}
+
+// Close closes the Client's connection. Any query in progress is aborted,
+// and subsequent queries fail.
+func (c *Client) Close() error {
+	return c.con.Close()
+}
+
+// exchange performs a single query over the Client's connection. It returns
+// the query exchange, which may be partially complete if an error occurs.
+func (c *Client) exchange(opt *QueryOptions) (*query, error) {
+	// Set a timeout on the connection.
+	c.con.SetDeadline(time.Now().Add(opt.Timeout))
+
+	// Build the query message.
+	q, err := newQuery(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transmit the query and keep track of when it was transmitted.
+	q.xmitTime = time.Now()
+	_, err = c.con.Write(q.xmitBuf)
+	if err != nil {
+		return q, err
+	}
+
+	// Receive datagrams until one of them answers the query. Replies to
+	// earlier queries that arrived after their deadlines are ignored.
+	recvBuf := make([]byte, opt.MaxResponseSize+1)
+	for {
+		recvBytes, err := c.con.Read(recvBuf)
+		if err != nil {
+			return q, err
+		}
+		if org, ok := originTime(recvBuf[:recvBytes]); !ok || !q.originMatches(org) {
+			continue
+		}
+		q.remote = c.con.RemoteAddr()
+		return q, q.parseResponse(recvBuf[:recvBytes])
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineClientQuery(t *testing.T) {
+	var written [][]byte
+	dials := 0
+	dial := fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		written = append(written, q)
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	opt := QueryOptions{
+		Dialer: func(la, ra string) (net.Conn, error) {
+			dials++
+			return dial(la, ra)
+		},
+	}
+
+	c, err := NewClient("remote", opt)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		r, err := c.Query()
+		assert.Nil(t, err)
+		assert.Nil(t, r.Validate())
+	}
+
+	// The connection is reused, but each query has its own transmit time.
+	assert.Equal(t, 1, dials)
+	assert.Equal(t, 3, len(written))
+	seen := make(map[uint64]bool)
+	for _, q := range written {
+		seen[binary.BigEndian.Uint64(q[40:])] = true
+	}
+	assert.Equal(t, 3, len(seen))
+}
+
+func TestOfflineClientLateReply(t *testing.T) {
+	// The reply to the first query is delayed until after the second query
+	// is sent. Each reply reports a distinct stratum.
+	var held []byte
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			if held == nil {
+				held = makeReply(q, func(h *header) { h.Stratum = 1 })
+				return nil
+			}
+			reply := makeReply(q, func(h *header) { h.Stratum = 2 })
+			return []datagram{{held, addr}, {reply, addr}}
+		}),
+	}
+
+	c, err := NewClient("remote", opt)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	_, err = c.Query()
+	assert.Equal(t, timeoutError{}, err)
+
+	r, err := c.Query()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(2), r.Stratum)
+}
+
+func TestOfflineClientClose(t *testing.T) {
+	addr := startServer(t, func(q []byte) [][]byte {
+		return [][]byte{makeReply(q, nil)}
+	})
+
+	c, err := NewClient(addr.String(), QueryOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = c.Query()
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.Close())
+	r, err := c.Query()
+	assert.Nil(t, r)
+	assert.NotNil(t, err)
+}
+
+func TestOfflineClientAuth(t *testing.T) {
+	// The authentication key is decoded when the Client is created.
+	opt := QueryOptions{
+		Auth:   AuthOptions{AuthMD5, "HEX:6376755a794e3443384858386", 1},
+		Dialer: fakeDialer(nil),
+	}
+	c, err := NewClient("remote", opt)
+	assert.Nil(t, c)
+	assert.Equal(t, ErrInvalidAuthKey, err)
+}
@@ -0,0 +1,120 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The binary encoding of a Response is a fixed-layout, big-endian record.
+// The first byte contains the encoding format version, which allows the
+// layout to evolve without breaking previously stored records.
+//
+// Format version 1:
+//
+//	offset  size  field
+//	     0     1  format version
+//	     1     1  Version
+//	     2     1  Stratum
+//	     3     1  Leap
+//	     4     4  ReferenceID
+//	     8     8  ClockOffset (ns)
+//	    16     8  RTT (ns)
+//	    24     8  Precision (ns)
+//	    32     8  RootDelay (ns)
+//	    40     8  RootDispersion (ns)
+//	    48     8  RootDistance (ns)
+//	    56     8  MinError (ns)
+//	    64     8  Poll (ns)
+//	    72    12  Time (unix seconds, nanoseconds)
+//	    84    12  ReferenceTime (unix seconds, nanoseconds)
+const (
+	binaryFormatVersion = 1
+	binaryFormatSize    = 96
+)
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface. It
+// encodes the response's time synchronization fields into a compact,
+// versioned, fixed-size record suitable for high-volume storage. Fields
+// that can be derived from the encoded values, such as KissCode, are
+// reconstructed by UnmarshalBinary. Authentication results and raw packet
+// data are not encoded.
+func (r *Response) MarshalBinary() ([]byte, error) {
+	b := make([]byte, binaryFormatSize)
+	b[0] = binaryFormatVersion
+	b[1] = uint8(r.Version)
+	b[2] = r.Stratum
+	b[3] = uint8(r.Leap)
+	binary.BigEndian.PutUint32(b[4:], r.ReferenceID)
+
+	durations := []time.Duration{
+		r.ClockOffset, r.RTT, r.Precision, r.RootDelay,
+		r.RootDispersion, r.RootDistance, r.MinError, r.Poll,
+	}
+	for i, d := range durations {
+		binary.BigEndian.PutUint64(b[8+8*i:], uint64(d))
+	}
+
+	putUnixTime(b[72:], r.Time)
+	putUnixTime(b[84:], r.ReferenceTime)
+	return b, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. It
+// decodes a record produced by MarshalBinary into the response, replacing
+// its previous contents.
+func (r *Response) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty binary response record")
+	}
+	if data[0] != binaryFormatVersion {
+		return errors.New("unsupported binary response format version")
+	}
+	if len(data) < binaryFormatSize {
+		return errors.New("binary response record too short")
+	}
+
+	*r = Response{
+		Version:     int(data[1]),
+		Stratum:     data[2],
+		Leap:        LeapIndicator(data[3]),
+		ReferenceID: binary.BigEndian.Uint32(data[4:]),
+	}
+
+	durations := []*time.Duration{
+		&r.ClockOffset, &r.RTT, &r.Precision, &r.RootDelay,
+		&r.RootDispersion, &r.RootDistance, &r.MinError, &r.Poll,
+	}
+	for i, d := range durations {
+		*d = time.Duration(binary.BigEndian.Uint64(data[8+8*i:]))
+	}
+
+	r.Time = getUnixTime(data[72:])
+	r.ReferenceTime = getUnixTime(data[84:])
+
+	r.OutboundDelay = r.RTT / 2
+	r.InboundDelay = r.RTT - r.OutboundDelay
+	if r.Stratum == 0 {
+		r.KissCode = kissCode(r.ReferenceID)
+		r.UnknownKiss = r.KissCode != "" && !knownKissCodes[r.KissCode]
+	}
+	return nil
+}
+
+// putUnixTime encodes t into b as a 64-bit count of unix seconds followed by
+// a 32-bit count of nanoseconds.
+func putUnixTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+}
+
+// getUnixTime decodes a time encoded by putUnixTime.
+func getUnixTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint64(b))
+	nsec := int64(binary.BigEndian.Uint32(b[8:]))
+	return time.Unix(sec, nsec).UTC()
+}
@@ -0,0 +1,86 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"encoding"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*Response)(nil)
+	_ encoding.BinaryUnmarshaler = (*Response)(nil)
+)
+
+func TestOfflineBinaryRoundTrip(t *testing.T) {
+	start := time.Now()
+	h := &header{
+		Stratum:        2,
+		Poll:           6,
+		Precision:      -20,
+		RootDelay:      0x00000123,
+		RootDispersion: 0x00000456,
+		ReferenceID:    refID,
+		ReferenceTime:  toNtpTime(start.Add(-time.Minute)),
+		OriginTime:     toNtpTime(start),
+		ReceiveTime:    toNtpTime(start.Add(20 * time.Millisecond)),
+		TransmitTime:   toNtpTime(start.Add(21 * time.Millisecond)),
+	}
+	h.setVersion(4)
+	h.setLeap(LeapAddSecond)
+
+	r := generateResponse(h, toNtpTime(start.Add(3*time.Millisecond)), nil)
+	b, err := r.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, binaryFormatSize, len(b))
+	assert.Equal(t, byte(binaryFormatVersion), b[0])
+
+	var r2 Response
+	assert.Nil(t, r2.UnmarshalBinary(b))
+	assert.Equal(t, r.ClockOffset, r2.ClockOffset)
+	assert.Equal(t, r.RTT, r2.RTT)
+	assert.Equal(t, r.OutboundDelay, r2.OutboundDelay)
+	assert.Equal(t, r.InboundDelay, r2.InboundDelay)
+	assert.Equal(t, r.Precision, r2.Precision)
+	assert.Equal(t, r.Version, r2.Version)
+	assert.Equal(t, r.Stratum, r2.Stratum)
+	assert.Equal(t, r.ReferenceID, r2.ReferenceID)
+	assert.Equal(t, r.RootDelay, r2.RootDelay)
+	assert.Equal(t, r.RootDispersion, r2.RootDispersion)
+	assert.Equal(t, r.RootDistance, r2.RootDistance)
+	assert.Equal(t, r.MinError, r2.MinError)
+	assert.Equal(t, r.Poll, r2.Poll)
+	assert.Equal(t, r.Leap, r2.Leap)
+	assert.True(t, r.Time.Equal(r2.Time))
+	assert.True(t, r.ReferenceTime.Equal(r2.ReferenceTime))
+
+	// Kiss codes are reconstructed from the reference ID.
+	kod := Response{Stratum: 0, ReferenceID: 0x52415445}
+	b, _ = kod.MarshalBinary()
+	assert.Nil(t, r2.UnmarshalBinary(b))
+	assert.Equal(t, "RATE", r2.KissCode)
+
+	// Zero times survive the round trip.
+	b, _ = (&Response{}).MarshalBinary()
+	assert.Nil(t, r2.UnmarshalBinary(b))
+	assert.True(t, r2.Time.IsZero())
+	assert.True(t, r2.ReferenceTime.IsZero())
+}
+
+func TestOfflineBinaryVersion(t *testing.T) {
+	b, _ := SyntheticResponse(0).MarshalBinary()
+	var r Response
+
+	b[0] = binaryFormatVersion + 1
+	assert.NotNil(t, r.UnmarshalBinary(b))
+
+	b[0] = binaryFormatVersion
+	assert.NotNil(t, r.UnmarshalBinary(b[:binaryFormatSize-1]))
+	assert.NotNil(t, r.UnmarshalBinary(nil))
+	assert.Nil(t, r.UnmarshalBinary(b))
+}
@@ -0,0 +1,13 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+// +build !plan9
+
+package ntp
+
+import "syscall"
+
+// errConnRefused is the error reported when a connection is refused.
+var errConnRefused error = syscall.ECONNREFUSED
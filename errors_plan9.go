@@ -0,0 +1,11 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build plan9
+// +build plan9
+
+package ntp
+
+// Plan 9 doesn't report refused connections using a distinct error value.
+var errConnRefused error
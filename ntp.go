@@ -12,13 +12,18 @@ package ntp
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/ipv4"
@@ -33,13 +38,135 @@ var (
 	ErrInvalidProtocolVersion = errors.New("invalid protocol version requested")
 	ErrInvalidStratum         = errors.New("invalid stratum in response")
 	ErrInvalidTime            = errors.New("invalid time reported")
+	ErrInvalidTimestampOrder  = errors.New("server timestamps out of order with client timestamps")
 	ErrInvalidTransmitTime    = errors.New("invalid transmit time in response")
 	ErrKissOfDeath            = errors.New("kiss of death received")
+	ErrOptionUnsupported      = errors.New("socket option not supported")
+	ErrResponseTooLarge       = errors.New("response exceeds maximum size")
 	ErrServerClockFreshness   = errors.New("server clock not fresh")
 	ErrServerResponseMismatch = errors.New("server response didn't match request")
 	ErrServerTickedBackwards  = errors.New("server clock ticked backwards")
+	ErrTooManyQueries         = errors.New("too many queries to distinguish with origin match mask")
+	ErrUnexpectedSource       = errors.New("response received from unexpected address")
+	ErrVersionMismatch        = errors.New("unaccepted protocol version in response")
 )
 
+// A QueryErrorClass is a broad categorization of the cause of a failed
+// query. See ClassifyError.
+type QueryErrorClass int
+
+const (
+	// ClassUnknown indicates an error whose cause couldn't be determined.
+	ClassUnknown QueryErrorClass = iota
+
+	// ClassTimeout indicates the server didn't respond before the deadline.
+	ClassTimeout
+
+	// ClassRefused indicates the server's host refused the connection,
+	// typically because no NTP server is listening on the port.
+	ClassRefused
+
+	// ClassDNSFailure indicates the server's address couldn't be resolved.
+	ClassDNSFailure
+
+	// ClassAuthFailure indicates symmetric key authentication failed or the
+	// authentication key was invalid.
+	ClassAuthFailure
+
+	// ClassKissOfDeath indicates the server sent a "kiss of death" response.
+	ClassKissOfDeath
+
+	// ClassInvalidResponse indicates the server's response was malformed or
+	// unsuitable for time synchronization.
+	ClassInvalidResponse
+)
+
+var errorClassNames = []string{
+	"unknown",
+	"timeout",
+	"refused",
+	"dns failure",
+	"auth failure",
+	"kiss of death",
+	"invalid response",
+}
+
+// String returns a short description of the error class.
+func (c QueryErrorClass) String() string {
+	if c < 0 || int(c) >= len(errorClassNames) {
+		return errorClassNames[ClassUnknown]
+	}
+	return errorClassNames[c]
+}
+
+// ClassifyError returns the class of error returned by a query or by
+// Response.Validate. It allows callers to react to broad categories of
+// failure without comparing against every error value this package may
+// return. A nil error is reported as ClassUnknown.
+func ClassifyError(err error) QueryErrorClass {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ClassUnknown
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrInvalidAuthKey):
+		return ClassAuthFailure
+	case errors.Is(err, ErrKissOfDeath):
+		return ClassKissOfDeath
+	case errors.Is(err, ErrInvalidDispersion),
+		errors.Is(err, ErrInvalidLeapSecond),
+		errors.Is(err, ErrInvalidMode),
+		errors.Is(err, ErrInvalidStratum),
+		errors.Is(err, ErrInvalidTime),
+		errors.Is(err, ErrInvalidTimestampOrder),
+		errors.Is(err, ErrInvalidTransmitTime),
+		errors.Is(err, ErrResponseTooLarge),
+		errors.Is(err, ErrServerClockFreshness),
+		errors.Is(err, ErrServerResponseMismatch),
+		errors.Is(err, ErrServerTickedBackwards),
+		errors.Is(err, ErrUnexpectedSource),
+		errors.Is(err, ErrVersionMismatch):
+		return ClassInvalidResponse
+	case errors.As(err, &dnsErr):
+		return ClassDNSFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case errConnRefused != nil && errors.Is(err, errConnRefused):
+		return ClassRefused
+	default:
+		return ClassUnknown
+	}
+}
+
+// A QueryError is returned by a query using the DetailedErrors option when
+// the server's response was received but rejected. It wraps the underlying
+// error, so errors.Is may still be used to identify the cause.
+type QueryError struct {
+	// Err is the reason the response was rejected.
+	Err error
+
+	// Response contains the fields of the rejected response as sent by the
+	// server. Because the response failed the client's checks, its values
+	// must not be used for time synchronization. It is nil if the response
+	// was too short to contain an NTP header.
+	Response *Response
+
+	// RawResponse contains the exact bytes of the datagram received from
+	// the server, which may be useful when reporting problems with a
+	// server. If the datagram exceeded MaxResponseSize, only its first
+	// MaxResponseSize bytes are included.
+	RawResponse []byte
+}
+
+func (e *QueryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
 // The LeapIndicator is used to warn if a leap second should be inserted
 // or deleted in the last minute of the current month.
 type LeapIndicator uint8
@@ -58,35 +185,80 @@ const (
 	LeapNotInSync = 3
 )
 
+// ClientIDFieldType is the extension field type used to carry the
+// QueryOptions ClientID. It lies outside the range of field types assigned
+// by IANA.
+const ClientIDFieldType = 0xf5c1
+
 // Internal constants
 const (
 	defaultNtpVersion = 4
 	defaultNtpPort    = 123
 	nanoPerSec        = 1000000000
+	headerSize        = 48
 	maxStratum        = 16
 	defaultTimeout    = 5 * time.Second
-	maxPollInterval   = (1 << 17) * time.Second
+	defaultSampleWait = 2 * time.Second // interval between QueryBest samples
+	defaultMaxRespLen = 1024
+	minPoll           = 4  // minimum poll exponent (16s)
+	maxPoll           = 17 // maximum poll exponent (~36h)
+	maxPollInterval   = (1 << maxPoll) * time.Second
 	maxDispersion     = 16 * time.Second
+	maxDistance       = 1 * time.Second
+	maxOriginAttempts = 64    // attempts to pick a distinct masked transmit time
+	phi               = 15e-6 // frequency tolerance (15 PPM)
+	fallbackDelay     = 250 * time.Millisecond
+	maxClientIDLen    = 255
+	localPrecision    = time.Nanosecond        // resolution of the local clock
+	minHopDelay       = 10 * time.Microsecond  // least plausible delay of a network hop
+	maxRootDelayRatio = 10                     // root delay limit as a multiple of RTT
+	rootDelaySlack    = 100 * time.Millisecond // root delay allowed beyond the ratio
 )
 
 // Internal variables
 var (
 	ntpEra0 = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
 	ntpEra1 = time.Date(2036, 2, 7, 6, 28, 16, 0, time.UTC)
+
+	// eraPivot is the earliest time a timestamp in a server response is
+	// assumed to represent, unless overridden by the EraPivot query option.
+	// See ntpTime.Time.
+	eraPivot = time.Unix(0, 0)
 )
 
-type mode uint8
+// The standard kiss codes defined by RFC 5905 section 7.4 and RFC 8915.
+var knownKissCodes = map[string]bool{
+	"ACST": true,
+	"AUTH": true,
+	"AUTO": true,
+	"BCST": true,
+	"CRYP": true,
+	"DENY": true,
+	"DROP": true,
+	"RSTR": true,
+	"INIT": true,
+	"MCST": true,
+	"NKEY": true,
+	"NTSN": true,
+	"RATE": true,
+	"RMOT": true,
+	"STEP": true,
+}
+
+// A Mode identifies the role of the sender of an NTP packet. This package
+// sends only client mode queries and expects server mode responses.
+type Mode uint8
 
-// NTP modes. This package uses only client mode.
+// NTP modes.
 const (
-	reserved mode = 0 + iota
-	symmetricActive
-	symmetricPassive
-	client
-	server
-	broadcast
-	controlMessage
-	reservedPrivate
+	ModeReserved Mode = 0 + iota
+	ModeSymmetricActive
+	ModeSymmetricPassive
+	ModeClient
+	ModeServer
+	ModeBroadcast
+	ModeControlMessage
+	ModeReservedPrivate
 )
 
 // An ntpTime is a 64-bit fixed-point (Q32.32) representation of the number of
@@ -111,12 +283,20 @@ func (t ntpTime) Time() time.Time {
 	// Assume NTP era 1 (year 2036+) if the raw timestamp suggests a year
 	// before 1970. Otherwise assume NTP era 0. This allows the function to
 	// report an accurate time value both before and after the 0-to-1 era
-	// rollover.
-	const t1970 = 0x83aa7e8000000000
-	if uint64(t) < t1970 {
-		return ntpEra1.Add(t.Duration())
+	// rollover. The pivot is fixed rather than derived from the local
+	// clock, so a client whose clock has not yet been set still decodes
+	// timestamps correctly.
+	return t.timeAfter(eraPivot)
+}
+
+// timeAfter interprets the fixed-point ntpTime as the absolute time in the
+// NTP era that places it at or after pivot and within 2^32 seconds of it.
+func (t ntpTime) timeAfter(pivot time.Time) time.Time {
+	p, era := ToNTPTime(pivot)
+	if uint64(t) < p {
+		era++
 	}
-	return ntpEra0.Add(t.Duration())
+	return FromNTPTime(uint64(t), era)
 }
 
 // toNtpTime converts the time.Time value t into its 64-bit fixed-point
@@ -132,6 +312,49 @@ func toNtpTime(t time.Time) ntpTime {
 	return ntpTime(sec<<32 | frac)
 }
 
+// ToNTPTime converts the time t into a 64-bit NTP timestamp and the NTP era
+// in which the timestamp falls. Era 0 began at 1900-01-01 00:00:00 UTC and
+// era 1 begins at 2036-02-07 06:28:16 UTC. Times before 1900 fall in
+// negative eras. The fractional part of the timestamp is rounded to the
+// nearest 2^-32 second.
+func ToNTPTime(t time.Time) (v uint64, era int) {
+	sec := t.Unix() - ntpEra0.Unix()
+	frac := (uint64(t.Nanosecond())<<32 + nanoPerSec/2) / nanoPerSec
+	era = int(sec >> 32)
+	return uint64(sec)<<32 | frac, era
+}
+
+// FromNTPTime converts the 64-bit NTP timestamp v within the given NTP era
+// into a time.Time value. It is the inverse of ToNTPTime. Unlike the times
+// reported in a Response, which are assumed to fall between 1970 and 2106,
+// the era is never inferred.
+func FromNTPTime(v uint64, era int) time.Time {
+	sec := int64(era)<<32 + int64(v>>32) + ntpEra0.Unix()
+	nsec := ntpTime(v & 0xffffffff).Duration()
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+// FromNTPTimeAfter converts the 64-bit NTP timestamp v into a time.Time
+// value, inferring its NTP era from pivot. The timestamp is interpreted as
+// the earliest time at or after pivot that it can represent, so the result
+// falls within the 136-year span beginning at pivot.
+//
+// The Time and ReferenceTime fields of a Response are decoded as though
+// by FromNTPTimeAfter with the pivot given by the EraPivot query option.
+func FromNTPTimeAfter(v uint64, pivot time.Time) time.Time {
+	return ntpTime(v).timeAfter(pivot)
+}
+
+// diff returns the signed duration between the timestamps a and b (a-b).
+// The timestamps may be in neighboring NTP eras.
+func diff(a, b ntpTime) time.Duration {
+	d := int64(a - b)
+	if d < 0 {
+		return -ntpTime(-d).Duration()
+	}
+	return ntpTime(d).Duration()
+}
+
 // An ntpTimeShort is a 32-bit fixed-point (Q16.16) representation of the
 // number of seconds elapsed.
 type ntpTimeShort uint32
@@ -169,7 +392,7 @@ func (h *header) setVersion(v int) {
 }
 
 // setMode sets the NTP protocol mode on the header.
-func (h *header) setMode(md mode) {
+func (h *header) setMode(md Mode) {
 	h.LiVnMode = (h.LiVnMode & 0xf8) | uint8(md)
 }
 
@@ -184,8 +407,8 @@ func (h *header) getVersion() int {
 }
 
 // getMode returns the mode value in the header.
-func (h *header) getMode() mode {
-	return mode(h.LiVnMode & 0x07)
+func (h *header) getMode() Mode {
+	return Mode(h.LiVnMode & 0x07)
 }
 
 // getLeap returns the leap indicator on the header.
@@ -208,6 +431,14 @@ type Extension interface {
 	ProcessResponse(buf []byte) error
 }
 
+// A Resolver looks up the IP addresses of a host. The *net.Resolver type
+// satisfies this interface.
+type Resolver interface {
+	// LookupIP looks up the host for the given network ("ip", "ip4" or
+	// "ip6") and returns a slice of its IP addresses.
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
 // QueryOptions contains configurable options used by the QueryWithOptions
 // function.
 type QueryOptions struct {
@@ -218,6 +449,20 @@ type QueryOptions struct {
 	// Version of the NTP protocol to use. Defaults to 4.
 	Version int
 
+	// AcceptVersions is the set of NTP protocol versions accepted in the
+	// server's response. Responses reporting any other version are
+	// rejected with ErrVersionMismatch. This may be used to reject
+	// responses from older servers that answer a version 4 query with a
+	// version 3 response. If empty, responses of any version are accepted.
+	AcceptVersions []int
+
+	// MaxResponseSize is the size in bytes of the largest response datagram
+	// the client accepts. Larger responses are rejected with
+	// ErrResponseTooLarge without being processed. Defaults to 1024 bytes,
+	// which accommodates the NTP header, a MAC and typical extension
+	// fields.
+	MaxResponseSize int
+
 	// LocalAddress contains the local IP address to use when creating a
 	// connection to the remote NTP server. This may be useful when the local
 	// system has more than one IP address. This address should not contain
@@ -228,14 +473,80 @@ type QueryOptions struct {
 	// is dropped by the network. Defaults to the local system's default value.
 	TTL int
 
+	// DontRoute causes the query datagram to bypass the routing table by
+	// setting the SO_DONTROUTE socket option. The server must then be on a
+	// directly connected network. This may be useful when querying NTP
+	// appliances on a management network. It requires a connection created
+	// by the default dialer or a custom dialer returning a connection that
+	// implements syscall.Conn.
+	DontRoute bool
+
+	// Warmup causes a throwaway query to be sent to the server before the
+	// query whose response is returned. The first exchange on a cold path
+	// is often slowed by DNS lookups, ARP resolution and route setup, which
+	// inflate its round trip delay and the error of its clock offset. The
+	// result of the throwaway query, including any error, is discarded and
+	// isn't reported to the OnComplete callback. Because two queries are
+	// sent in quick succession, servers that enforce a minimum interval
+	// between queries may respond to the second with a RATE kiss of death.
+	// QueryManyPacketConn sends a throwaway query to each server. The option
+	// is ignored by CollectResponses, which sends no queries, and by Client,
+	// whose connection is warmed by its earlier queries.
+	Warmup bool
+
+	// SampleInterval is the time QueryBest waits between successive queries
+	// to the server. Defaults to 2 seconds, the interval between the
+	// queries of a burst sent by the reference NTP implementation, which
+	// servers enforcing rate limits generally accept.
+	SampleInterval time.Duration
+
+	// ClockTickTolerance is the amount by which the server's receive time
+	// may exceed its transmit time before the response is rejected with
+	// ErrServerTickedBackwards. A small tolerance may be used to accept
+	// responses from servers with coarse clocks whose timestamps are
+	// rounded inconsistently. Defaults to 0, which rejects any overage.
+	// The returned error wraps ErrServerTickedBackwards and reports the
+	// measured overage, so use errors.Is to test for it.
+	ClockTickTolerance time.Duration
+
+	// EraPivot is the earliest time the server's timestamps are assumed to
+	// represent when decoding the Response's Time and ReferenceTime fields.
+	// Because NTP timestamps repeat every 2^32 seconds (about 136 years),
+	// each is decoded as the earliest time at or after the pivot that it
+	// can represent. Defaults to 1970-01-01 00:00:00 UTC, which decodes
+	// timestamps accurately from 1970 until 2106, across the 2036 era
+	// rollover. The default is fixed rather than derived from the local
+	// clock, so that a client whose clock hasn't been set yet, and which
+	// may be querying the server in order to set it, still decodes the
+	// server's timestamps correctly. Applications expecting timestamps
+	// outside that span, such as those testing servers deliberately set far
+	// in the future, may set a pivot preceding the times they expect.
+	// Fields derived from the differences between timestamps, such as
+	// ClockOffset and RTT, are unaffected by the era.
+	EraPivot time.Time
+
 	// Auth contains the settings used to configure NTP symmetric key
 	// authentication. See RFC 5905 for further details.
 	Auth AuthOptions
 
+	// PreparedAuth contains symmetric key authentication settings that have
+	// been prepared in advance by PrepareAuth. When set, it is used instead
+	// of Auth.
+	PreparedAuth *PreparedAuth
+
 	// Extensions may be added to modify NTP queries before they are
 	// transmitted and to process NTP responses after they arrive.
 	Extensions []Extension
 
+	// ClientID is an optional identifier attached to the query in a
+	// vendor-specific extension field of type ClientIDFieldType, allowing
+	// operators of private NTP infrastructure to log which clients are
+	// querying their servers. The field is not part of any NTP standard.
+	// Compliant servers ignore unknown extension fields, but some servers
+	// may drop queries containing them, so it should only be used with
+	// servers known to accept it. It may be at most 255 bytes long.
+	ClientID string
+
 	// Dialer is a callback used to override the default UDP network dialer.
 	// The localAddress is directly copied from the LocalAddress field
 	// specified in QueryOptions. It may be the empty string or a host address
@@ -244,17 +555,121 @@ type QueryOptions struct {
 	// remoteAddress is guaranteed to include a port number.
 	Dialer func(localAddress, remoteAddress string) (net.Conn, error)
 
+	// DialerContext is a context-aware variant of Dialer. When set, it is
+	// used in preference to Dialer, and it receives the context passed to
+	// QueryWithContext, allowing a custom dialer to abandon a connection
+	// attempt when the context is cancelled. Other query functions pass it
+	// a background context.
+	DialerContext func(ctx context.Context, localAddress, remoteAddress string) (net.Conn, error)
+
+	// Resolver is used by the default UDP network dialer to resolve the
+	// server's host name. This may be useful for directing DNS queries to a
+	// custom service or for testing. Defaults to Go's built-in resolver.
+	// The Resolver is not used when a custom Dialer is provided.
+	Resolver Resolver
+
 	// Dial is a callback used to override the default UDP network dialer.
 	//
 	// DEPRECATED. Use Dialer instead.
 	Dial func(laddr string, lport int, raddr string, rport int) (net.Conn, error)
 
+	// OnOriginMismatch is an optional diagnostic callback invoked when the
+	// origin timestamp echoed by the server doesn't match the transmit
+	// timestamp sent in the query. Both values are raw 64-bit NTP
+	// timestamps. A mismatch that follows a consistent pattern across
+	// queries may indicate a middlebox (such as a carrier-grade NAT) that
+	// rewrites NTP payloads. The query still fails with
+	// ErrServerResponseMismatch after the callback returns.
+	OnOriginMismatch func(sent, echoed uint64)
+
+	// ExpectRemoteAddr is the IP address from which the server's response
+	// must be received. It is intended for QueryPacketConn,
+	// QueryManyPacketConn and CollectResponses, since the operating system
+	// doesn't filter the datagrams received by an unconnected packet
+	// connection by their source, and it hardens such queries against
+	// responses injected by off-path attackers. On those paths, datagrams
+	// from any other address are deliberately ignored rather than reported
+	// as ErrUnexpectedSource, so that a spoofed datagram can't make the
+	// query fail; a query that receives nothing from the expected address
+	// times out. A connected socket already discards datagrams from any
+	// source other than the address it was dialed to, so for other queries
+	// the option checks only the dialed address: if the server's host name
+	// resolved to a different IP, the query fails with ErrUnexpectedSource.
+	ExpectRemoteAddr net.IP
+
+	// HighPrecision causes the Response's OffsetFloat field to be
+	// populated with the clock offset computed without rounding.
+	HighPrecision bool
+
+	// SkipInternalChecks disables the checks normally applied to the
+	// server's response before a Response is generated: that it has the
+	// server mode, a nonzero transmit time, an origin time echoing the
+	// query, and a transmit time no earlier than its receive time. It may
+	// be useful for inspecting malformed responses or debugging servers.
+	// The resulting Response may be unusable for timekeeping and should
+	// always be checked with Validate before use. Replies received by
+	// QueryPacketConn are still matched to the query by origin time.
+	SkipInternalChecks bool
+
+	// DetailedErrors causes a query whose response is received but rejected
+	// (for example, because of an invalid mode or a mismatched origin
+	// timestamp) to return a *QueryError containing the rejected response
+	// and the raw bytes received.
+	// This may help diagnose problems with noncompliant servers. Because
+	// the returned error is no longer one of this package's error values,
+	// use errors.Is to test for specific causes.
+	DetailedErrors bool
+
+	// OriginMatchMask selects the bits of the response's origin timestamp
+	// that must echo the query's transmit timestamp. Bits that are clear in
+	// the mask are ignored, which allows queries to succeed through broken
+	// middleboxes that rewrite the low bits of the origin timestamp. The
+	// random transmit timestamp protects against spoofed responses, and
+	// every bit excluded from the comparison halves the work an off-path
+	// attacker must do to forge a response that will be accepted, so the
+	// mask should exclude as few bits as possible. Defaults to all bits.
+	OriginMatchMask uint64
+
+	// OnComplete is an optional callback invoked after every query, whether
+	// it succeeded or failed. It receives an Event describing the complete
+	// exchange, which may be useful for audit trails and diagnostics.
+	OnComplete func(e Event)
+
 	// Port indicates the port used to reach the remote NTP server.
 	//
 	// DEPRECATED. Embed the port number in the query address string instead.
 	Port int
 }
 
+// An Event describes a completed query exchange. It is passed to the
+// OnComplete callback in QueryOptions.
+type Event struct {
+	// Address is the address of the server that was queried.
+	Address string
+
+	// Request contains the raw bytes of the query sent to the server. It is
+	// nil if the query failed before the message was composed.
+	Request []byte
+
+	// Reply contains the raw bytes of the server's response. It is nil if
+	// no response was received.
+	Reply []byte
+
+	// SendTime is the local system time at which the query was sent.
+	SendTime time.Time
+
+	// ReceiveTime is the local system time at which the server's response
+	// was received.
+	ReceiveTime time.Time
+
+	// Response is the Response generated from the server's reply. It is nil
+	// if the query failed.
+	Response *Response
+
+	// Err is the error returned by the query, if any.
+	Err error
+}
+
 // A Response contains time data, some of which is returned by the NTP server
 // and some of which is calculated by this client.
 type Response struct {
@@ -264,6 +679,13 @@ type Response struct {
 	// clock.
 	ClockOffset time.Duration
 
+	// OffsetFloat is the same clock offset as ClockOffset, expressed in
+	// seconds. ClockOffset is rounded to the nearest nanosecond, while
+	// OffsetFloat retains the full sub-nanosecond resolution of the NTP
+	// timestamps. It is only populated when the HighPrecision query option
+	// is set.
+	OffsetFloat float64
+
 	// Time is the time the server transmitted this response, measured using
 	// its own clock. You should not use this value for time synchronization
 	// purposes. Add ClockOffset to your system clock instead.
@@ -273,12 +695,30 @@ type Response struct {
 	// and the server.
 	RTT time.Duration
 
+	// OutboundDelay and InboundDelay are estimates of the one-way network
+	// delays from the client to the server and from the server to the
+	// client. NTP cannot measure these directly, so each is assumed to be
+	// half of RTT. Callers who know the path is asymmetric may compute their
+	// own split of RTT.
+	OutboundDelay time.Duration
+	InboundDelay  time.Duration
+
 	// Precision is the reported precision of the server's clock.
 	Precision time.Duration
 
+	// PrecisionExp is the reported precision of the server's clock as a
+	// signed log2 exponent of seconds. For example, -29 indicates a
+	// precision of 2^-29 seconds (~1.9ns). Unlike Precision, it isn't
+	// rounded to the nearest nanosecond.
+	PrecisionExp int8
+
 	// Version is the NTP protocol version number reported by the server.
 	Version int
 
+	// Mode is the NTP mode reported by the server. Responses to client
+	// queries always use ModeServer.
+	Mode Mode
+
 	// Stratum is the "stratum level" of the server. The smaller the number,
 	// the closer the server is to the reference clock. Stratum 1 servers are
 	// attached directly to the reference clock. A stratum value of 0
@@ -299,7 +739,8 @@ type Response struct {
 	ReferenceTime time.Time
 
 	// RootDelay is the server's estimated aggregate round-trip-time delay to
-	// the stratum 1 server.
+	// the stratum 1 server. It doesn't include the round trip between the
+	// client and the server, which is reported by RTT.
 	RootDelay time.Duration
 
 	// RootDispersion is the server's estimated maximum measurement error
@@ -307,7 +748,10 @@ type Response struct {
 	RootDispersion time.Duration
 
 	// RootDistance is an estimate of the total synchronization distance
-	// between the client and the stratum 1 server.
+	// between the client and the stratum 1 server. When the RTT is
+	// effectively zero, as with a server on the loopback interface, it
+	// reduces to half the RootDelay plus the RootDispersion reported by the
+	// server.
 	RootDistance time.Duration
 
 	// Leap indicates whether a leap second should be added or removed from
@@ -319,7 +763,8 @@ type Response struct {
 	// clock, the reported timestamps may appear to violate the principle of
 	// causality. In other words, the NTP server's response may indicate
 	// that a message was received before it was sent. In such cases, the
-	// minimum error may be useful.
+	// minimum error may be useful. It is zero for any exchange without a
+	// causality violation, including one with an RTT of zero.
 	MinError time.Duration
 
 	// KissCode is a 4-character string describing the reason for a
@@ -327,11 +772,242 @@ type Response struct {
 	// codes, see https://tools.ietf.org/html/rfc5905#section-7.4.
 	KissCode string
 
+	// UnknownKiss is true if the server sent a "kiss of death" response
+	// (stratum=0) whose printable kiss code isn't one of the standard codes
+	// defined by RFC 5905 or RFC 8915.
+	UnknownKiss bool
+
 	// Poll is the maximum interval between successive NTP query messages to
 	// the server.
 	Poll time.Duration
 
-	authErr error
+	// RemoteAddr is the network address from which the response was
+	// received.
+	RemoteAddr net.Addr
+
+	// TrailingBytes contains any data the server appended to the 48-byte
+	// NTP header, such as extension fields or vendor-specific data. A MAC
+	// that was successfully verified is not included. It is nil if the
+	// response consisted of the header alone.
+	TrailingBytes []byte
+
+	// ExtensionFields contains the NTPv4 extension fields (RFC 7822) found
+	// in TrailingBytes, in the order they appeared. Parsing stops at the
+	// first data that isn't a well-formed extension field, such as a MAC
+	// that wasn't verified. The fields' data shares memory with
+	// TrailingBytes.
+	ExtensionFields []ExtensionField
+
+	// RawRequest and RawResponse contain the exact bytes of the query sent
+	// to the server and the datagram received in reply, including any
+	// extension fields and MAC. They may be useful when investigating the
+	// behavior of unusual servers. CollectResponses sets only RawResponse.
+	// They are not preserved by MarshalBinary.
+	RawRequest  []byte
+	RawResponse []byte
+
+	// SendInstant and RecvInstant are the local system times at which the
+	// query was sent and the response was received. Both include a reading
+	// of the monotonic clock, so the duration between them, computed with
+	// RecvInstant.Sub(SendInstant), is unaffected by any changes made to the
+	// local system clock during the exchange. They are not preserved by
+	// MarshalBinary.
+	SendInstant time.Time
+	RecvInstant time.Time
+
+	authErr       error
+	authenticated bool  // true if the query requested authentication
+	lvm           uint8 // raw leap indicator, version and mode byte
+
+	// Raw timestamps of the exchange: org is the client's transmit time, rec
+	// is the server's receive time, xmt is the server's transmit time, and
+	// dst is the client's receive time.
+	org, rec, xmt, dst ntpTime
+}
+
+// A Measurement bundles the values most applications need from a Response
+// in order to correct the local clock.
+type Measurement struct {
+	// Offset is the estimated offset of the local system clock relative to
+	// the server's clock.
+	Offset time.Duration
+
+	// Uncertainty bounds the error of Offset. It is the sum of the
+	// response's RootDistance and MinError.
+	Uncertainty time.Duration
+
+	// Time is the corrected local time at the moment the response was
+	// received.
+	Time time.Time
+
+	// Quality rates the measurement on a scale from 0 (unusable) to 1
+	// (perfect). It falls linearly as Uncertainty approaches the one second
+	// distance threshold beyond which the reference NTP implementation
+	// considers a server unfit for synchronization. Responses that fail
+	// validation have a Quality of 0.
+	Quality float64
+}
+
+// Measurement returns the response's offset, its uncertainty and related
+// values bundled into a single Measurement.
+func (r *Response) Measurement() Measurement {
+	m := Measurement{
+		Offset:      r.ClockOffset,
+		Uncertainty: r.RootDistance + r.MinError,
+		Time:        r.dst.Time().Add(r.ClockOffset),
+	}
+	if r.Validate() == nil && m.Uncertainty < maxDistance {
+		m.Quality = 1 - m.Uncertainty.Seconds()/maxDistance.Seconds()
+	}
+	return m
+}
+
+// PathToReference returns the round-trip delay and the dispersion
+// accumulated along the server's path to its primary (stratum 1) reference
+// source, as reported by the server in its RootDelay and RootDispersion
+// fields. These describe the server's own synchronization path only. They
+// are not measurements of the path between the client and the server,
+// which is described by RTT. The total error budget of the client's clock
+// offset combines both paths and is reported by RootDistance.
+func (r *Response) PathToReference() (delay, dispersion time.Duration) {
+	return r.RootDelay, r.RootDispersion
+}
+
+// IsAccurateEnough returns true if the uncertainty of the response's clock
+// offset, the sum of its RootDistance and MinError, is within the accuracy
+// budget. A response may pass validation yet still be too imprecise for an
+// application's needs. IsAccurateEnough does not validate the response.
+func (r *Response) IsAccurateEnough(budget time.Duration) bool {
+	return r.RootDistance+r.MinError <= budget
+}
+
+// DownstreamStratum returns the stratum a server synchronized to the
+// response's server should advertise to its own clients, one greater than
+// the response's Stratum. The result is clamped at 16, the stratum
+// indicating an unsynchronized server, so a client of an unsynchronized
+// server is itself unsynchronized.
+func (r *Response) DownstreamStratum() uint8 {
+	if r.Stratum >= maxStratum {
+		return maxStratum
+	}
+	return r.Stratum + 1
+}
+
+// AgreesWith returns true if the response's clock offset is within tolerance
+// of referenceOffset, an offset of the local system clock measured
+// independently of NTP, for example by a local GPS or PPS reference clock.
+// Disagreement may indicate a misconfigured or compromised server. The
+// comparison is inclusive of the tolerance.
+func (r *Response) AgreesWith(referenceOffset, tolerance time.Duration) bool {
+	d := r.ClockOffset - referenceOffset
+	if d < 0 {
+		d = -d
+	}
+	return d <= tolerance
+}
+
+// A Correction holds a clock offset anchored to the instant it was measured.
+// It converts readings of Go's monotonic clock into corrected times, so the
+// times it reports are unaffected by any changes made to the local system
+// clock after the measurement. Because it doesn't estimate the frequency
+// error of the local clock, its accuracy degrades as the measurement ages.
+type Correction struct {
+	// Offset is the measured offset of the local system clock relative to
+	// the server's clock.
+	Offset time.Duration
+
+	// Time is the local system time at which the offset was measured. It
+	// includes a monotonic clock reading when the correction is derived
+	// from a query.
+	Time time.Time
+}
+
+// Correction returns the response's clock offset anchored to the instant
+// the response was received.
+func (r *Response) Correction() Correction {
+	t := r.RecvInstant
+	if t.IsZero() {
+		t = r.dst.Time()
+	}
+	return Correction{Offset: r.ClockOffset, Time: t}
+}
+
+// Now returns the current corrected time: the corrected time of the
+// measurement advanced by the time elapsed since, as measured by the
+// monotonic clock.
+func (c Correction) Now() time.Time {
+	return c.Time.Add(c.Offset).Add(time.Since(c.Time))
+}
+
+// SyntheticResponse returns a valid Response whose ClockOffset is the
+// requested offset. The remaining fields contain plausible values for a
+// stratum 2 server with a 10ms round-trip time. It is intended as a test aid
+// for code that consumes Response values and should not be used for time
+// synchronization.
+func SyntheticResponse(offset time.Duration) *Response {
+	const rtt = 10 * time.Millisecond
+
+	now := time.Now()
+	h := &header{
+		Stratum:        2,
+		Poll:           6,
+		Precision:      -20,
+		RootDelay:      ntpTimeShort(0x0000028f), // ~10ms
+		RootDispersion: ntpTimeShort(0x00000148), // ~5ms
+		ReferenceID:    0xc0000201,
+		ReferenceTime:  toNtpTime(now.Add(offset - time.Minute)),
+		OriginTime:     toNtpTime(now),
+		ReceiveTime:    toNtpTime(now.Add(offset + rtt/2)),
+		TransmitTime:   toNtpTime(now.Add(offset + rtt/2)),
+	}
+	h.setVersion(defaultNtpVersion)
+	h.setMode(ModeServer)
+
+	r := generateResponse(h, toNtpTime(now.Add(rtt)), nil)
+	r.SendInstant = now
+	r.RecvInstant = now.Add(rtt)
+
+	// Avoid any rounding error introduced by the timestamp conversions.
+	r.ClockOffset = offset
+	return r
+}
+
+// NextPoll returns the local system time at which the caller should query
+// the server again in order to keep the response's synchronization distance
+// within the accuracy budget. The distance starts at RootDistance and grows
+// at the frequency tolerance rate PHI (15 PPM) as the response ages. The
+// returned time is no earlier than the server's Poll interval, which avoids
+// rate limiting, and no later than the maximum NTP poll interval (~36 hours).
+func (r *Response) NextPoll(accuracyBudget time.Duration) time.Time {
+	wait := r.Poll
+	secs := (accuracyBudget - r.RootDistance).Seconds() / phi
+	switch {
+	case secs >= maxPollInterval.Seconds():
+		wait = maxPollInterval
+	case secs > wait.Seconds():
+		wait = time.Duration(secs * nanoPerSec)
+	}
+	if wait > maxPollInterval {
+		wait = maxPollInterval
+	}
+	return r.dst.Time().Add(wait)
+}
+
+// MaxAge returns how long after it was received the response may be relied
+// upon before its synchronization distance exceeds the accuracy budget. The
+// distance starts at RootDistance and grows at the frequency tolerance rate
+// PHI (15 PPM) as the response ages. It returns 0 if the response's
+// RootDistance already exceeds the budget. Unlike NextPoll, the result
+// isn't adjusted to respect the server's poll interval.
+func (r *Response) MaxAge(budget time.Duration) time.Duration {
+	if budget <= r.RootDistance {
+		return 0
+	}
+	secs := (budget - r.RootDistance).Seconds() / phi
+	if secs >= float64(math.MaxInt64)/nanoPerSec {
+		return math.MaxInt64
+	}
+	return time.Duration(secs * nanoPerSec)
 }
 
 // IsKissOfDeath returns true if the response is a "kiss of death" from the
@@ -341,6 +1017,446 @@ func (r *Response) IsKissOfDeath() bool {
 	return r.Stratum == 0
 }
 
+// LeapWithin returns true if the server signals an impending leap second
+// and the leap will occur within d of the server's transmit time. Leap
+// seconds occur at the end of the last minute of the month in UTC, so this
+// allows applications to prepare for a leap (for example, by beginning to
+// smear it) only when it's close rather than for the entire month.
+func (r *Response) LeapWithin(d time.Duration) bool {
+	if r.Leap != LeapAddSecond && r.Leap != LeapDelSecond {
+		return false
+	}
+	t := r.Time.UTC()
+	monthEnd := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return monthEnd.Sub(t) <= d
+}
+
+// IsLoopback returns true if the response was received from a loopback
+// address, such as 127.0.0.1 or ::1. The round-trip time to such a server
+// is effectively zero, so values derived from the RTT, such as the one-way
+// delays, are degenerate and the RootDistance reflects only the server's
+// own synchronization distance.
+func (r *Response) IsLoopback() bool {
+	ip := addrIP(r.RemoteAddr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// UsesLocalClockFallback returns true if the response indicates the server
+// is serving time from its own undisciplined local clock, typically after
+// losing synchronization with its upstream sources. Such servers identify
+// their reference as "LOCL" or "LCL", or by an address of the form
+// 127.127.1.x assigned to the reference implementation's local clock
+// driver, often at a high stratum such as 10. Although these servers
+// continue to answer queries, their time is not traceable to a reliable
+// source.
+func (r *Response) UsesLocalClockFallback() bool {
+	if r.Stratum == 0 {
+		return false
+	}
+	switch {
+	case r.ReferenceID == 0x4c4f434c: // "LOCL"
+		return true
+	case r.ReferenceID == 0x4c434c00: // "LCL"
+		return true
+	case r.ReferenceID&0xffffff00 == 0x7f7f0100: // 127.127.1.x
+		return true
+	default:
+		return false
+	}
+}
+
+// ServerProcessingDelay returns the amount of time the server spent between
+// receiving the query and transmitting its response, as measured by the
+// server's clock. A large processing delay may indicate an overloaded
+// server.
+func (r *Response) ServerProcessingDelay() time.Duration {
+	return diff(r.xmt, r.rec)
+}
+
+// FormatTimes returns the response's timestamps formatted using the
+// time.Time layout in the location loc. The returned map is keyed by
+// "ReferenceTime", "OriginTime", "ReceiveTime", "TransmitTime" and
+// "DestinationTime". The origin and destination times are the local
+// system's transmit and receive times; the others were reported by the
+// server.
+func (r *Response) FormatTimes(layout string, loc *time.Location) map[string]string {
+	return map[string]string{
+		"ReferenceTime":   r.ReferenceTime.In(loc).Format(layout),
+		"OriginTime":      r.org.Time().In(loc).Format(layout),
+		"ReceiveTime":     r.rec.Time().In(loc).Format(layout),
+		"TransmitTime":    r.Time.In(loc).Format(layout),
+		"DestinationTime": r.dst.Time().In(loc).Format(layout),
+	}
+}
+
+// Human-readable names of the leap indicators and modes, reported by ToMap.
+var (
+	leapNames = []string{"no warning", "add second", "delete second", "not in sync"}
+	modeNames = []string{
+		"reserved", "symmetric active", "symmetric passive", "client",
+		"server", "broadcast", "control", "private",
+	}
+)
+
+// ToMap returns the response's fields as a flat map keyed by field name,
+// suitable for use with templating engines and structured loggers. Values
+// are decoded into human-readable forms: durations and times are formatted
+// as strings (times in RFC 3339 format), the leap indicator and mode are
+// named, ReferenceID is formatted by ReferenceString, and TrailingBytes,
+// RawRequest and RawResponse are hex-encoded. Version, Stratum and
+// PrecisionExp are ints, OffsetFloat is a float64 and UnknownKiss is a
+// bool. ExtensionFields is a slice of maps, each holding a field's Type as
+// an int and its Data hex-encoded. Every exported field is reported.
+// FromMap performs the reverse conversion.
+func (r *Response) ToMap() map[string]interface{} {
+	fields := make([]map[string]interface{}, len(r.ExtensionFields))
+	for i, f := range r.ExtensionFields {
+		fields[i] = map[string]interface{}{
+			"Type": int(f.Type),
+			"Data": hex.EncodeToString(f.Data),
+		}
+	}
+
+	m := map[string]interface{}{
+		"Time":            r.Time.Format(time.RFC3339Nano),
+		"ClockOffset":     r.ClockOffset.String(),
+		"OffsetFloat":     r.OffsetFloat,
+		"RTT":             r.RTT.String(),
+		"OutboundDelay":   r.OutboundDelay.String(),
+		"InboundDelay":    r.InboundDelay.String(),
+		"Precision":       r.Precision.String(),
+		"PrecisionExp":    int(r.PrecisionExp),
+		"Version":         r.Version,
+		"Mode":            modeNames[r.Mode&7],
+		"Stratum":         int(r.Stratum),
+		"ReferenceID":     r.ReferenceString(),
+		"ReferenceTime":   r.ReferenceTime.Format(time.RFC3339Nano),
+		"RootDelay":       r.RootDelay.String(),
+		"RootDispersion":  r.RootDispersion.String(),
+		"RootDistance":    r.RootDistance.String(),
+		"Leap":            leapNames[r.Leap&3],
+		"MinError":        r.MinError.String(),
+		"KissCode":        r.KissCode,
+		"UnknownKiss":     r.UnknownKiss,
+		"Poll":            r.Poll.String(),
+		"RemoteAddr":      "",
+		"TrailingBytes":   hex.EncodeToString(r.TrailingBytes),
+		"ExtensionFields": fields,
+		"RawRequest":      hex.EncodeToString(r.RawRequest),
+		"RawResponse":     hex.EncodeToString(r.RawResponse),
+		"SendInstant":     r.SendInstant.Format(time.RFC3339Nano),
+		"RecvInstant":     r.RecvInstant.Format(time.RFC3339Nano),
+	}
+	if r.RemoteAddr != nil {
+		m["RemoteAddr"] = r.RemoteAddr.String()
+	}
+	return m
+}
+
+// FromMap decodes a map produced by ToMap into the response, replacing its
+// previous contents. Integer values may also be float64, as produced by
+// decoding the map from JSON. ExtensionFields is recovered by parsing
+// TrailingBytes, and RemoteAddr, if not empty, is decoded as a UDP address.
+// SendInstant and RecvInstant lose their monotonic clock readings. As with
+// UnmarshalBinary, the authentication results, which aren't exported, are
+// not restored. Because ReferenceString replaces unprintable characters,
+// the ReferenceID of a stratum 0 or 1 response containing them can't be
+// recovered exactly; they are decoded as zero bytes.
+func (r *Response) FromMap(m map[string]interface{}) error {
+	d := mapDecoder{m: m}
+	*r = Response{
+		Time:           d.time("Time"),
+		ClockOffset:    d.duration("ClockOffset"),
+		OffsetFloat:    d.float("OffsetFloat"),
+		RTT:            d.duration("RTT"),
+		OutboundDelay:  d.duration("OutboundDelay"),
+		InboundDelay:   d.duration("InboundDelay"),
+		Precision:      d.duration("Precision"),
+		PrecisionExp:   int8(d.int("PrecisionExp")),
+		Version:        d.int("Version"),
+		Mode:           Mode(d.name("Mode", modeNames)),
+		Stratum:        uint8(d.int("Stratum")),
+		ReferenceTime:  d.time("ReferenceTime"),
+		RootDelay:      d.duration("RootDelay"),
+		RootDispersion: d.duration("RootDispersion"),
+		RootDistance:   d.duration("RootDistance"),
+		Leap:           LeapIndicator(d.name("Leap", leapNames)),
+		MinError:       d.duration("MinError"),
+		KissCode:       d.string("KissCode"),
+		UnknownKiss:    d.bool("UnknownKiss"),
+		Poll:           d.duration("Poll"),
+		TrailingBytes:  d.bytes("TrailingBytes"),
+		RawRequest:     d.bytes("RawRequest"),
+		RawResponse:    d.bytes("RawResponse"),
+		SendInstant:    d.time("SendInstant"),
+		RecvInstant:    d.time("RecvInstant"),
+	}
+	r.ReferenceID = d.referenceID("ReferenceID", r.Stratum)
+	if addr := d.string("RemoteAddr"); addr != "" {
+		r.RemoteAddr = d.udpAddr("RemoteAddr", addr)
+	}
+	if r.TrailingBytes != nil {
+		r.ExtensionFields = parseExtensionFields(r.TrailingBytes)
+	}
+	if d.err != nil {
+		*r = Response{}
+	}
+	return d.err
+}
+
+// A mapDecoder decodes the values of a map produced by ToMap. After the
+// first failure, its methods return zero values, and err records the cause.
+type mapDecoder struct {
+	m   map[string]interface{}
+	err error
+}
+
+func (d *mapDecoder) value(key string) interface{} {
+	if d.err != nil {
+		return nil
+	}
+	v := d.m[key]
+	if v == nil {
+		d.err = fmt.Errorf("missing %s in response map", key)
+	}
+	return v
+}
+
+func (d *mapDecoder) fail(key string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("invalid %s in response map", key)
+	}
+}
+
+func (d *mapDecoder) string(key string) string {
+	v := d.value(key)
+	s, ok := v.(string)
+	if !ok {
+		d.fail(key)
+	}
+	return s
+}
+
+func (d *mapDecoder) bool(key string) bool {
+	v := d.value(key)
+	b, ok := v.(bool)
+	if !ok {
+		d.fail(key)
+	}
+	return b
+}
+
+func (d *mapDecoder) int(key string) int {
+	switch v := d.value(key).(type) {
+	case int:
+		return v
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v)
+		}
+	}
+	d.fail(key)
+	return 0
+}
+
+func (d *mapDecoder) float(key string) float64 {
+	switch v := d.value(key).(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	d.fail(key)
+	return 0
+}
+
+// bytes decodes a hex-encoded value. An empty string is decoded as nil.
+func (d *mapDecoder) bytes(key string) []byte {
+	s := d.string(key)
+	if s == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		d.fail(key)
+	}
+	return b
+}
+
+func (d *mapDecoder) duration(key string) time.Duration {
+	s := d.string(key)
+	if d.err != nil {
+		return 0
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		d.fail(key)
+	}
+	return v
+}
+
+func (d *mapDecoder) time(key string) time.Time {
+	s := d.string(key)
+	if d.err != nil {
+		return time.Time{}
+	}
+	v, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		d.fail(key)
+	}
+	return v
+}
+
+// udpAddr decodes a UDP address containing a literal IP address, without
+// performing a host name lookup.
+func (d *mapDecoder) udpAddr(key, s string) net.Addr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		d.fail(key)
+		return nil
+	}
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		d.fail(key)
+		return nil
+	}
+	return &net.UDPAddr{IP: ip, Port: p, Zone: zone}
+}
+
+// name returns the index of the value in names.
+func (d *mapDecoder) name(key string, names []string) int {
+	s := d.string(key)
+	for i, n := range names {
+		if n == s {
+			return i
+		}
+	}
+	d.fail(key)
+	return 0
+}
+
+// referenceID decodes a reference ID formatted by ReferenceString for a
+// response with the given stratum.
+func (d *mapDecoder) referenceID(key string, stratum uint8) uint32 {
+	s := d.string(key)
+	if d.err != nil {
+		return 0
+	}
+
+	var b [4]byte
+	switch stratum {
+	case 0, 1:
+		if stratum == 1 {
+			if len(s) < 2 || s[0] != '.' || s[len(s)-1] != '.' {
+				d.fail(key)
+				return 0
+			}
+			s = s[1 : len(s)-1]
+		}
+		i := 0
+		for _, ch := range s {
+			if i == len(b) {
+				d.fail(key)
+				return 0
+			}
+			if ch >= 32 && ch <= 126 {
+				b[i] = byte(ch)
+			}
+			i++
+		}
+	default:
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			d.fail(key)
+			return 0
+		}
+		copy(b[:], ip)
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// RFCStats returns the clock offset (theta), round-trip delay (delta) and
+// dispersion (epsilon) statistics of the exchange, as computed by the
+// packet procedure of the reference implementation described in RFC 5905
+// appendix A.5.1.1. The offset is identical to ClockOffset. The delay is
+// RTT, but no less than the precision of the local clock. The dispersion
+// is the sum of the server's and the local clock's precisions plus the
+// maximum error accumulated by the local clock over the exchange at the
+// frequency tolerance of 15 PPM. The precision of the local clock is taken
+// to be one nanosecond, the resolution of Go's time package.
+func (r *Response) RFCStats() (offset, delay, dispersion time.Duration) {
+	offset = r.ClockOffset
+
+	delay = r.RTT
+	if delay < localPrecision {
+		delay = localPrecision
+	}
+
+	elapsed := ntpTime(r.dst - r.org).Duration()
+	dispersion = r.Precision + localPrecision + time.Duration(phi*float64(elapsed))
+	return offset, delay, dispersion
+}
+
+// PrecisionString returns the server's precision as its log2 exponent
+// followed by an approximate human-readable duration, for example
+// "-29 (~1.9ns)".
+func (r *Response) PrecisionString() string {
+	v := math.Ldexp(1, int(r.PrecisionExp))
+	units := []string{"s", "ms", "µs", "ns", "ps", "fs", "as"}
+	i := 0
+	for v < 1 && i < len(units)-1 {
+		v *= 1000
+		i++
+	}
+	switch {
+	case v < 1:
+		v = math.Ldexp(1, int(r.PrecisionExp))
+		return fmt.Sprintf("%d (~%.1es)", r.PrecisionExp, v)
+	case v < 10:
+		return fmt.Sprintf("%d (~%.1f%s)", r.PrecisionExp, v, units[i])
+	default:
+		return fmt.Sprintf("%d (~%.0f%s)", r.PrecisionExp, v, units[i])
+	}
+}
+
+// RootDelaySane reports whether the server's reported RootDelay is
+// plausible given its stratum and the measured RTT. A response is flagged
+// as suspect if any of the following hold:
+//
+//   - The root delay is negative or exceeds one second, which would make
+//     the server's time unfit for synchronization under RFC 5905 anyway.
+//   - The server is synchronized to an upstream server (stratum 2 or
+//     greater), but its root delay is less than 10µs for each hop between
+//     it and the primary server. No network hop is that fast, so such a
+//     root delay is implausibly small.
+//   - The RTT was measured (it is nonzero), and the root delay exceeds ten
+//     times the RTT plus 100ms. A server's path to the primary server may
+//     be longer than the client's path to the server, but not by this much
+//     unless the server is misreporting its delay.
+//
+// Responses failing this check often come from misconfigured servers.
+// "Kiss of death" responses (stratum 0) are always considered sane, since
+// their root delay is meaningless.
+func (r *Response) RootDelaySane() bool {
+	switch {
+	case r.Stratum == 0:
+		return true
+	case r.RootDelay < 0 || r.RootDelay > maxDistance:
+		return false
+	case r.Stratum >= 2 && r.RootDelay < time.Duration(r.Stratum-1)*minHopDelay:
+		return false
+	case r.RTT > 0 && r.RootDelay > maxRootDelayRatio*r.RTT+rootDelaySlack:
+		return false
+	default:
+		return true
+	}
+}
+
 // ReferenceString returns the response's ReferenceID value formatted as a
 // string. If the response's stratum is zero, then the "kiss o' death" string
 // is returned. If stratum is one, then the server is a reference clock and
@@ -375,9 +1491,54 @@ func (r *Response) ReferenceString() string {
 	return fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3])
 }
 
+// ValidateOptions contains configurable options used by the
+// ValidateWithOptions function.
+type ValidateOptions struct {
+	// AllowNotInSync causes responses with a LeapNotInSync leap indicator to
+	// be accepted. Some servers transiently report this state after a
+	// restart while still serving usable time. Such responses deserve less
+	// trust than those from a synchronized server. It is equivalent to
+	// including LeapNotInSync in AcceptedLeaps.
+	AllowNotInSync bool
+
+	// AcceptedLeaps is the set of leap indicator values considered valid.
+	// Responses with any other leap indicator are rejected. If nil, it
+	// defaults to LeapNoWarning, LeapAddSecond and LeapDelSecond.
+	AcceptedLeaps []LeapIndicator
+
+	// CheckTimestampOrder causes responses to be rejected with
+	// ErrInvalidTimestampOrder unless the four timestamps of the exchange
+	// are in causal order: the server must have received the query after
+	// the client sent it, and the client must have received the response
+	// after the server sent it. This can expose forged responses. However,
+	// because the client's timestamps are taken from the local clock and
+	// the server's from its own, any clock offset between them can
+	// legitimately break the ordering. Only use this check when the local
+	// clock is known to be synchronized to within TimestampOrderTolerance.
+	CheckTimestampOrder bool
+
+	// TimestampOrderTolerance is the amount by which timestamps may be out
+	// of order before CheckTimestampOrder rejects a response.
+	TimestampOrderTolerance time.Duration
+
+	// MaxStratum is the stratum ceiling. Responses with a stratum greater
+	// than or equal to this value are rejected. Defaults to 16, which NTP
+	// uses to indicate an unsynchronized server. Private networks running
+	// deep chains of servers may raise the ceiling. It has no effect on the
+	// handling of "kiss of death" (stratum 0) responses.
+	MaxStratum int
+}
+
 // Validate checks if the response is valid for the purposes of time
 // synchronization.
 func (r *Response) Validate() error {
+	return r.ValidateWithOptions(ValidateOptions{})
+}
+
+// ValidateWithOptions performs the same function as Validate but allows for
+// the customization of certain validation checks. See the comments for
+// ValidateOptions for further details.
+func (r *Response) ValidateWithOptions(opt ValidateOptions) error {
 	// Forward authentication errors.
 	if r.authErr != nil {
 		return r.authErr
@@ -387,12 +1548,17 @@ func (r *Response) Validate() error {
 	if r.Stratum == 0 {
 		return ErrKissOfDeath
 	}
-	if r.Stratum >= maxStratum {
+	if opt.MaxStratum == 0 {
+		opt.MaxStratum = maxStratum
+	}
+	if int(r.Stratum) >= opt.MaxStratum {
 		return ErrInvalidStratum
 	}
 
 	// Estimate the "freshness" of the time. If it exceeds the maximum
 	// polling interval (~36 hours), then it cannot be considered "fresh".
+	// Both times are decoded into the NTP era nearest the present, so the
+	// check remains valid across the 2036 era rollover.
 	freshness := r.Time.Sub(r.ReferenceTime)
 	if freshness > maxPollInterval {
 		return ErrServerClockFreshness
@@ -415,14 +1581,89 @@ func (r *Response) Validate() error {
 	}
 
 	// Handle invalid leap second indicator.
-	if r.Leap == LeapNotInSync {
+	if !opt.acceptsLeap(r.Leap) {
 		return ErrInvalidLeapSecond
 	}
 
+	// Check that the server's timestamps fall between the client's.
+	if opt.CheckTimestampOrder {
+		tol := -opt.TimestampOrderTolerance
+		if diff(r.rec, r.org) < tol || diff(r.dst, r.xmt) < tol {
+			return ErrInvalidTimestampOrder
+		}
+	}
+
 	// nil means the response is valid.
 	return nil
 }
 
+// LeapVersionMode returns the first byte of the server's response exactly
+// as it was sent. It packs the leap indicator into the two most significant
+// bits, the protocol version into the next three bits, and the mode into
+// the three least significant bits. The Leap, Version and Mode fields are
+// decoded from it. It may be useful when debugging servers that send
+// unexpected values. It is not preserved by MarshalBinary.
+func (r *Response) LeapVersionMode() uint8 {
+	return r.lvm
+}
+
+// AuthValid reports whether the server's response was authenticated with a
+// MAC that verified, independent of the time checks performed by Validate.
+// If authentication wasn't requested, it returns false with a nil error. If
+// the MAC failed to verify, it returns false with the authentication error.
+// Unlike Validate, it allows applications to distinguish an unauthenticated
+// response from one whose authentication failed.
+func (r *Response) AuthValid() (bool, error) {
+	if r.authErr != nil {
+		return false, r.authErr
+	}
+	return r.authenticated, nil
+}
+
+// Health validates the response and returns a brief summary suitable for
+// display to operators. If the response is valid, the summary reports the
+// clock offset and the server's stratum, for example "synced, offset
+// 1.250ms, stratum 2". Otherwise it describes the reason the response
+// failed validation, for example "rate limited" or "stale clock".
+func (r *Response) Health() (ok bool, summary string) {
+	err := r.Validate()
+	switch {
+	case err == nil:
+		offset := float64(r.ClockOffset) / float64(time.Millisecond)
+		return true, fmt.Sprintf("synced, offset %.3fms, stratum %d", offset, r.Stratum)
+	case err == ErrKissOfDeath && r.KissCode == "RATE":
+		return false, "rate limited"
+	case err == ErrKissOfDeath:
+		return false, fmt.Sprintf("kiss of death (%s)", r.KissCode)
+	case err == ErrInvalidStratum, err == ErrInvalidLeapSecond:
+		return false, "not synchronized"
+	case err == ErrInvalidDispersion:
+		return false, "too imprecise"
+	case err == ErrServerClockFreshness:
+		return false, "stale clock"
+	case err == ErrInvalidTime:
+		return false, "causality violation"
+	default:
+		return false, err.Error()
+	}
+}
+
+// acceptsLeap reports whether the leap indicator li is considered valid.
+func (opt *ValidateOptions) acceptsLeap(li LeapIndicator) bool {
+	if li == LeapNotInSync && opt.AllowNotInSync {
+		return true
+	}
+	if opt.AcceptedLeaps == nil {
+		return li != LeapNotInSync
+	}
+	for _, l := range opt.AcceptedLeaps {
+		if l == li {
+			return true
+		}
+	}
+	return false
+}
+
 // Query requests time data from a remote NTP server. The response contains
 // information from which a more accurate local time can be inferred.
 //
@@ -439,12 +1680,17 @@ func Query(address string) (*Response, error) {
 // customization of certain query behaviors. See the comments for Query and
 // QueryOptions for further details.
 func QueryWithOptions(address string, opt QueryOptions) (*Response, error) {
-	h, now, err := getTime(address, &opt)
-	if err != nil && err != ErrAuthFailed {
-		return nil, err
-	}
+	q, err := sendQuery(context.Background(), address, &opt)
+	return finishQuery(address, &opt, q, err)
+}
 
-	return generateResponse(h, now, err), nil
+// QueryWithContext performs the same function as QueryWithOptions but
+// aborts the query when the context is cancelled, returning the context's
+// error. If the context has a deadline earlier than the one implied by the
+// Timeout option, the query fails at the context's deadline instead.
+func QueryWithContext(ctx context.Context, address string, opt QueryOptions) (*Response, error) {
+	q, err := sendQuery(ctx, address, &opt)
+	return finishQuery(address, &opt, q, err)
 }
 
 // Time returns the current, corrected local time using information returned
@@ -471,21 +1717,491 @@ func Time(address string) (time.Time, error) {
 	return time.Now().Add(r.ClockOffset), nil
 }
 
-// getTime performs the NTP server query and returns the response header
-// along with the local system time it was received.
-func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
-	if opt.Timeout == 0 {
-		opt.Timeout = defaultTimeout
+// TimeStrict returns the current, corrected local time using information
+// returned from the remote NTP server queried with the provided options.
+// Unlike Time, it never falls back to the uncorrected local system time: on
+// error, it returns the zero time.Time value along with the error. See
+// QueryWithOptions for a description of the address format.
+func TimeStrict(address string, opt QueryOptions) (time.Time, error) {
+	r, err := QueryWithOptions(address, opt)
+	if err != nil {
+		return time.Time{}, err
 	}
-	if opt.Version == 0 {
-		opt.Version = defaultNtpVersion
+
+	err = r.Validate()
+	if err != nil {
+		return time.Time{}, err
 	}
-	if opt.Version < 2 || opt.Version > 4 {
-		return nil, 0, ErrInvalidProtocolVersion
+
+	return time.Now().Add(r.ClockOffset), nil
+}
+
+// TimeChecked returns the current local time, corrected using information
+// returned from the remote NTP server queried with the provided options.
+// The applied result reports whether the correction was applied. Like Time,
+// it falls back to the uncorrected local system time if the query fails or
+// the response is invalid, in which case applied is false and the error is
+// returned. See QueryWithOptions for a description of the address format.
+func TimeChecked(address string, opt QueryOptions) (corrected time.Time, applied bool, err error) {
+	t, err := TimeStrict(address, opt)
+	if err != nil {
+		return time.Now(), false, err
 	}
-	if opt.Port == 0 {
-		opt.Port = defaultNtpPort
+	return t, true, nil
+}
+
+// IsReachable returns true if the NTP server at address returns a valid
+// response to a query using the provided options before the query times
+// out. It is intended for simple up/down health checks. The reason a server
+// is unreachable is discarded; use QueryWithOptions and Validate to obtain
+// detailed diagnostics.
+func IsReachable(address string, opt QueryOptions) bool {
+	r, err := QueryWithOptions(address, opt)
+	return err == nil && r.Validate() == nil
+}
+
+// A PreciseTime is the result of a PreciseTimeQuery. Its offset and
+// uncertainty are expressed in floating-point seconds, which retain the
+// sub-nanosecond detail of the NTP timestamps lost by time.Duration.
+type PreciseTime struct {
+	// Wall is the corrected local time at the moment the query completed.
+	Wall time.Time
+
+	// OffsetSeconds is the estimated offset of the local system clock
+	// relative to the server's clock.
+	OffsetSeconds float64
+
+	// UncertaintySeconds bounds the error of OffsetSeconds. It is the sum
+	// of the response's RootDistance and MinError.
+	UncertaintySeconds float64
+}
+
+// PreciseTimeQuery queries the NTP server at address using the provided
+// options and returns the corrected time along with the precise clock
+// offset and its uncertainty. Responses that fail validation are rejected.
+// See QueryWithOptions for a description of the address format.
+func PreciseTimeQuery(address string, opt QueryOptions) (PreciseTime, error) {
+	r, err := QueryWithOptions(address, opt)
+	if err != nil {
+		return PreciseTime{}, err
+	}
+
+	err = r.Validate()
+	if err != nil {
+		return PreciseTime{}, err
+	}
+
+	return r.preciseTime(time.Now()), nil
+}
+
+// preciseTime returns the PreciseTime of the response, correcting the local
+// system time now.
+func (r *Response) preciseTime(now time.Time) PreciseTime {
+	return PreciseTime{
+		Wall:               now.Add(r.ClockOffset),
+		OffsetSeconds:      offsetFloat(r.org, r.rec, r.xmt, r.dst),
+		UncertaintySeconds: (r.RootDistance + r.MinError).Seconds(),
+	}
+}
+
+// QueryPacketConn performs the same function as QueryWithOptions but sends
+// the query over an existing, unconnected packet connection to the server at
+// addr. Because a single packet connection may receive datagrams from many
+// peers, replies are matched to the query using the random transmit time
+// sent to the server; datagrams that don't match are discarded. The
+// connection is not closed when the query completes, but its read deadline
+// is modified. Only one query should be in flight on a connection at a time.
+func QueryPacketConn(conn net.PacketConn, addr net.Addr, opt QueryOptions) (*Response, error) {
+	q, err := sendPacketQuery(conn, addr, &opt)
+	return finishQuery(addr.String(), &opt, q, err)
+}
+
+// QueryManyPacketConn queries the servers at each of the addresses
+// concurrently over a single, unconnected packet connection. Each query
+// carries its own random transmit time, which the replies use to match
+// them to their queries regardless of the order in which they arrive. It
+// returns a response and an error for each address, in the same order as
+// addrs. The options, including the timeout, apply to the batch as a
+// whole. The connection is not closed, but its read deadline is modified.
+// If the OriginMatchMask option leaves too few distinct transmit times to
+// tell the queries apart, the error for each address that couldn't be
+// queried is ErrTooManyQueries.
+func QueryManyPacketConn(conn net.PacketConn, addrs []net.Addr, opt QueryOptions) ([]*Response, []error) {
+	queries, errs := sendPacketQueries(conn, addrs, &opt)
+	responses := make([]*Response, len(addrs))
+	for i, addr := range addrs {
+		responses[i], errs[i] = finishQuery(addr.String(), &opt, queries[i], errs[i])
+	}
+	return responses, errs
+}
+
+// QueryBest queries the server at address the given number of times, waiting
+// SampleInterval between queries, and returns the valid response with the
+// shortest round trip delay. This is the heuristic used by the clock filter
+// of the reference NTP implementation, since the response whose query and
+// reply spent the least time in transit is likely to be the least affected
+// by asymmetric network delays. Because each sample bounds the error of the
+// same pair of clocks, the returned response's MinError is the greatest
+// MinError of the valid samples. At least one query is sent. Sampling stops
+// early if the server sends a kiss of death. If no sample is valid, the
+// error of the last sample is returned.
+func QueryBest(address string, samples int, opt QueryOptions) (*Response, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	wait := opt.SampleInterval
+	if wait <= 0 {
+		wait = defaultSampleWait
+	}
+
+	var best *Response
+	var minError time.Duration
+	var err error
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+		}
+
+		var r *Response
+		r, err = QueryWithOptions(address, opt)
+		if err == nil {
+			err = r.Validate()
+		}
+		if err != nil {
+			if r != nil && r.IsKissOfDeath() {
+				break
+			}
+			continue
+		}
+
+		if r.MinError > minError {
+			minError = r.MinError
+		}
+		if best == nil || r.RTT < best.RTT {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return nil, err
+	}
+	best.MinError = minError
+	return best, nil
+}
+
+// QueryMany queries the servers at each of the addresses concurrently, each
+// over its own connection, and returns a response and an error for each
+// address, in the same order as addrs. Because the queries run in
+// parallel, the Timeout option bounds the duration of the batch as a
+// whole. A failed query doesn't affect the others. If an OnComplete
+// callback is provided, it may be invoked concurrently from several
+// goroutines. See QueryWithOptions for a description of the address
+// format.
+func QueryMany(addrs []string, opt QueryOptions) ([]*Response, []error) {
+	responses := make([]*Response, len(addrs))
+	errs := make([]error, len(addrs))
+
+	var wg sync.WaitGroup
+	for i, address := range addrs {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			responses[i], errs[i] = QueryWithOptions(address, opt)
+		}(i, address)
+	}
+	wg.Wait()
+	return responses, errs
+}
+
+// CollectResponses reads every NTP packet arriving on the packet connection
+// for the duration d, without sending a query, and returns the responses
+// parsed from them in the order they arrived. It may be used to listen for
+// broadcast or multicast packets, or to monitor the replies arriving on a
+// socket passively. Only server and broadcast mode packets are collected;
+// other datagrams are discarded, as are packets rejected by the
+// MaxResponseSize, ExpectRemoteAddr, AcceptVersions and Extensions
+// options.
+//
+// Because the packets don't answer a query sent by the caller, the round
+// trip delay can't be measured. Each response's ClockOffset assumes the
+// packet arrived with no delay, and its RTT is zero. If authentication is
+// configured, a response whose MAC fails to verify is still returned, but
+// fails validation. The Timeout and Warmup options are ignored. The
+// connection is not closed, but its read deadline is modified.
+// CollectResponses returns any read error other than the expiry of the
+// collection window, along with the responses collected before it occurred.
+func CollectResponses(conn net.PacketConn, d time.Duration, opt QueryOptions) ([]*Response, error) {
+	err := setDefaults(&opt)
+	if err != nil {
+		return nil, err
+	}
+	auth, key, err := authSettings(&opt)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(d))
+
+	var responses []*Response
+	recvBuf := make([]byte, opt.MaxResponseSize+1)
+	for {
+		recvBytes, from, err := conn.ReadFrom(recvBuf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = nil
+			}
+			return responses, err
+		}
+		buf := append([]byte(nil), recvBuf[:recvBytes]...)
+		r := parseUnsolicited(buf, from, time.Now(), &opt, auth, key)
+		if r != nil {
+			responses = append(responses, r)
+		}
+	}
+}
+
+// QueryHappyEyeballs performs the same function as QueryWithOptions, but when
+// the host name resolves to both IPv6 and IPv4 addresses, it races queries
+// over the two address families in the manner of RFC 8305 ("Happy
+// Eyeballs"). The IPv6 query is sent first, and the IPv4 query follows after
+// a short delay or as soon as the IPv6 query fails. The first valid response
+// is returned, and the slower query is cancelled. This improves reliability
+// on networks where one of the address families is broken.
+func QueryHappyEyeballs(host string, opt QueryOptions) (*Response, error) {
+	return queryHappyEyeballs(host, opt, fallbackDelay)
+}
+
+// queryHappyEyeballs implements QueryHappyEyeballs, starting the IPv4
+// query after the given delay if the IPv6 query hasn't yet completed.
+func queryHappyEyeballs(host string, opt QueryOptions, delay time.Duration) (*Response, error) {
+	port := opt.Port
+	if port == 0 {
+		port = defaultNtpPort
+	}
+	address, err := fixHostPort(host, port)
+	if err != nil {
+		return nil, err
+	}
+	hostname, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Choose the first resolved address from each address family, with IPv6
+	// preferred.
+	ips, err := lookupHost(opt.Resolver, hostname)
+	if err != nil {
+		return nil, err
+	}
+	var ip4, ip6 net.IP
+	for _, ip := range ips {
+		switch {
+		case ip.To4() != nil && ip4 == nil:
+			ip4 = ip
+		case ip.To4() == nil && ip6 == nil:
+			ip6 = ip
+		}
+	}
+	var addrs []string
+	for _, ip := range []net.IP{ip6, ip4} {
+		if ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), portString))
+		}
+	}
+	if len(addrs) == 1 {
+		return QueryWithOptions(addrs[0], opt)
+	}
+
+	// Each attempt is an ordinary query, so it dials the server exactly as
+	// QueryWithOptions would. The losing attempt is aborted by cancelling
+	// its context.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		r   *Response
+		err error
+	}
+	results := make([]result, len(addrs))
+	done := make(chan int, len(addrs))
+	start := func(i int) {
+		go func() {
+			r, err := QueryWithContext(ctx, addrs[i], opt)
+			results[i] = result{r, err}
+			done <- i
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	start(0)
+	started := 1
+	for finished := 0; finished < len(addrs); {
+		select {
+		case <-timer.C:
+			if started < len(addrs) {
+				start(started)
+				started++
+			}
+		case i := <-done:
+			finished++
+			if results[i].err == nil && results[i].r.Validate() == nil {
+				return results[i].r, nil
+			}
+			if started < len(addrs) {
+				start(started)
+				started++
+			}
+		}
+	}
+
+	// Neither attempt produced a valid response, so report the outcome of
+	// the preferred address family.
+	return results[0].r, results[0].err
+}
+
+// getTime performs the NTP server query and returns the response header
+// along with the local system time it was received.
+func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
+	q, err := sendQuery(context.Background(), address, opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	return q.recvHdr, q.dst, q.authErr
+}
+
+// finishQuery generates the Response for a query exchange that completed
+// with the error err, and reports the exchange to the OnComplete callback.
+// The query may be nil if the exchange failed before the query message was
+// composed.
+func finishQuery(address string, opt *QueryOptions, q *query, err error) (*Response, error) {
+	var r *Response
+	switch {
+	case err == nil:
+		r = generateResponse(q.recvHdr, q.dst, q.authErr)
+		decodeServerTimes(r, q.recvHdr, opt)
+		r.authenticated = q.auth.Type != AuthNone
+		r.TrailingBytes = q.trailing
+		r.ExtensionFields = parseExtensionFields(q.trailing)
+		r.RawRequest = q.xmitBuf[:len(q.xmitBuf):len(q.xmitBuf)]
+		r.RawResponse = q.recvBuf[:len(q.recvBuf):len(q.recvBuf)]
+		r.RemoteAddr = q.remote
+		r.SendInstant = q.xmitTime
+		r.RecvInstant = q.recvTime
+		if opt.HighPrecision {
+			r.OffsetFloat = offsetFloat(r.org, r.rec, r.xmt, r.dst)
+		}
+	case opt.DetailedErrors && q != nil && q.recvBuf != nil:
+		raw := q.recvBuf
+		if len(raw) > opt.MaxResponseSize {
+			raw = raw[:opt.MaxResponseSize:opt.MaxResponseSize]
+		}
+		qerr := &QueryError{Err: err, RawResponse: raw}
+		if q.recvHdr != nil {
+			qerr.Response = generateResponse(q.recvHdr, q.dst, nil)
+			decodeServerTimes(qerr.Response, q.recvHdr, opt)
+		}
+		err = qerr
+	}
+
+	if opt.OnComplete != nil {
+		e := Event{Address: address, Response: r, Err: err}
+		if q != nil {
+			e.Request = q.xmitBuf
+			e.Reply = q.recvBuf
+			e.SendTime = q.xmitTime
+			e.ReceiveTime = q.recvTime
+		}
+		opt.OnComplete(e)
+	}
+
+	return r, err
+}
+
+// sendQuery performs the NTP server query over a connection to the server at
+// address. It returns the query exchange, which may be partially complete
+// if an error occurs. If the context is cancelled or its deadline passes
+// before the exchange completes, the context's error is returned.
+func sendQuery(ctx context.Context, address string, opt *QueryOptions) (*query, error) {
+	err := setDefaults(opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Warmup {
+		w := *opt
+		w.Warmup = false
+		sendQuery(ctx, address, &w)
+	}
+
+	// Connect to the remote server.
+	con, err := dialServer(ctx, address, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	// Apply any requested socket options.
+	err = configureConn(con, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set a timeout on the connection.
+	con.SetDeadline(time.Now().Add(opt.Timeout))
+
+	// Abort any blocked read or write as soon as the context is cancelled
+	// or its deadline passes, whichever precedes the timeout.
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				con.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
 	}
+
+	// Build the query message.
+	q, err := newQuery(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transmit the query and keep track of when it was transmitted.
+	q.xmitTime = time.Now()
+	_, err = con.Write(q.xmitBuf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return q, ctx.Err()
+		}
+		return q, err
+	}
+
+	// Allocate a buffer big enough to hold the largest acceptable response
+	// datagram, plus one byte to detect a larger one.
+	recvBuf := make([]byte, opt.MaxResponseSize+1)
+
+	// Receive the response.
+	recvBytes, err := con.Read(recvBuf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return q, ctx.Err()
+		}
+		return q, err
+	}
+
+	q.remote = con.RemoteAddr()
+	return q, q.parseResponse(recvBuf[:recvBytes])
+}
+
+// dialServer connects to the server at address using the dialer selected by
+// the query options. If the context is cancelled or its deadline passes
+// before the connection is made, the context's error is returned.
+func dialServer(ctx context.Context, address string, opt *QueryOptions) (net.Conn, error) {
 	if opt.Dial != nil {
 		// wrapper for the deprecated Dial callback.
 		opt.Dialer = func(la, ra string) (net.Conn, error) {
@@ -494,148 +2210,591 @@ func getTime(address string, opt *QueryOptions) (*header, ntpTime, error) {
 	}
 	if opt.Dialer == nil {
 		opt.Dialer = defaultDialer
+		if opt.Resolver != nil {
+			opt.Dialer = resolvingDialer(opt.Resolver)
+		}
 	}
 
 	// Compose a conforming host:port remote address string if the address
 	// string doesn't already contain a port.
 	remoteAddress, err := fixHostPort(address, opt.Port)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	// Connect to the remote server.
-	con, err := opt.Dialer(opt.LocalAddress, remoteAddress)
+	var con net.Conn
+	if opt.DialerContext != nil {
+		con, err = opt.DialerContext(ctx, opt.LocalAddress, remoteAddress)
+	} else if err = ctx.Err(); err == nil {
+		con, err = opt.Dialer(opt.LocalAddress, remoteAddress)
+	}
 	if err != nil {
-		return nil, 0, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
-	defer con.Close()
+	return con, nil
+}
 
+// configureConn applies the socket options requested by the query options
+// to the connection.
+func configureConn(con net.Conn, opt *QueryOptions) error {
 	// Set a TTL for the packet if requested.
 	if opt.TTL != 0 {
 		ipcon := ipv4.NewConn(con)
-		err = ipcon.SetTTL(opt.TTL)
+		err := ipcon.SetTTL(opt.TTL)
 		if err != nil {
-			return nil, 0, err
+			return optionError("TTL", err)
 		}
 	}
 
+	// Bypass the routing table if requested.
+	if opt.DontRoute {
+		err := dontRoute(con)
+		if err != nil {
+			return optionError("DontRoute", err)
+		}
+	}
+	return nil
+}
+
+// sendPacketQuery performs the NTP server query over an unconnected packet
+// connection. It returns the query exchange, which may be partially
+// complete if an error occurs.
+func sendPacketQuery(conn net.PacketConn, addr net.Addr, opt *QueryOptions) (*query, error) {
+	err := setDefaults(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.Warmup {
+		w := *opt
+		w.Warmup = false
+		sendPacketQuery(conn, addr, &w)
+	}
+
 	// Set a timeout on the connection.
-	con.SetDeadline(time.Now().Add(opt.Timeout))
+	conn.SetReadDeadline(time.Now().Add(opt.Timeout))
 
-	// Allocate a buffer big enough to hold an entire response datagram.
-	recvBuf := make([]byte, 8192)
-	recvHdr := new(header)
+	// Build the query message.
+	q, err := newQuery(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transmit the query and keep track of when it was transmitted.
+	q.xmitTime = time.Now()
+	_, err = conn.WriteTo(q.xmitBuf, addr)
+	if err != nil {
+		return q, err
+	}
+
+	// Receive datagrams until one of them answers the query. Any datagram
+	// whose origin timestamp doesn't echo the query's transmit timestamp
+	// is a reply to some other query and is ignored, as is any datagram
+	// from an unexpected source, so that a spoofed reply can't abort the
+	// query.
+	recvBuf := make([]byte, opt.MaxResponseSize+1)
+	for {
+		recvBytes, from, err := conn.ReadFrom(recvBuf)
+		if err != nil {
+			return q, err
+		}
+		if opt.ExpectRemoteAddr != nil && !addrIP(from).Equal(opt.ExpectRemoteAddr) {
+			continue
+		}
+		if org, ok := originTime(recvBuf[:recvBytes]); !ok || !q.originMatches(org) {
+			continue
+		}
+		q.remote = from
+		return q, q.parseResponse(recvBuf[:recvBytes])
+	}
+}
+
+// sendPacketQueries performs concurrent NTP server queries to each of the
+// addresses over a single unconnected packet connection. It returns the
+// query exchanges and the errors for each address.
+func sendPacketQueries(conn net.PacketConn, addrs []net.Addr, opt *QueryOptions) ([]*query, []error) {
+	queries := make([]*query, len(addrs))
+	errs := make([]error, len(addrs))
+	err := setDefaults(opt)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return queries, errs
+	}
+
+	if opt.Warmup {
+		w := *opt
+		w.Warmup = false
+		sendPacketQueries(conn, addrs, &w)
+	}
+
+	// Set a timeout on the connection.
+	conn.SetReadDeadline(time.Now().Add(opt.Timeout))
+
+	// Transmit a query to each address. Replies are demultiplexed using the
+	// queries' random transmit times, so each query must use a distinct
+	// value. A narrow origin match mask leaves few distinct values, so the
+	// number of attempts to find an unused one is limited.
+	mask := ntpTime(opt.OriginMatchMask)
+	pending := make(map[ntpTime]int)
+	for i, addr := range addrs {
+		var q *query
+		err = ErrTooManyQueries
+		for n := 0; n < maxOriginAttempts && err == ErrTooManyQueries; n++ {
+			q, err = newQuery(opt)
+			if err == nil {
+				if _, dup := pending[q.xmitHdr.TransmitTime&mask]; dup {
+					err = ErrTooManyQueries
+				}
+			}
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		queries[i] = q
+
+		q.xmitTime = time.Now()
+		_, err = conn.WriteTo(q.xmitBuf, addr)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		pending[q.xmitHdr.TransmitTime&mask] = i
+	}
+
+	// Receive datagrams until every query is answered, discarding those
+	// that don't answer any of them or that arrive from an unexpected
+	// source.
+	recvBuf := make([]byte, opt.MaxResponseSize+1)
+	for len(pending) > 0 {
+		recvBytes, from, err := conn.ReadFrom(recvBuf)
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			break
+		}
+		if opt.ExpectRemoteAddr != nil && !addrIP(from).Equal(opt.ExpectRemoteAddr) {
+			continue
+		}
+		org, ok := originTime(recvBuf[:recvBytes])
+		if !ok {
+			continue
+		}
+		i, ok := pending[org&mask]
+		if !ok {
+			continue
+		}
+		delete(pending, org&mask)
+
+		q := queries[i]
+		q.remote = from
+		errs[i] = q.parseResponse(append([]byte(nil), recvBuf[:recvBytes]...))
+	}
+	return queries, errs
+}
+
+// setDefaults validates the query options and replaces unset values with
+// their defaults.
+func setDefaults(opt *QueryOptions) error {
+	if opt.Timeout == 0 {
+		opt.Timeout = defaultTimeout
+	}
+	if opt.Version == 0 {
+		opt.Version = defaultNtpVersion
+	}
+	if opt.Version < 2 || opt.Version > 4 {
+		return ErrInvalidProtocolVersion
+	}
+	if opt.Port == 0 {
+		opt.Port = defaultNtpPort
+	}
+	if opt.MaxResponseSize <= 0 {
+		opt.MaxResponseSize = defaultMaxRespLen
+	}
+	if opt.OriginMatchMask == 0 {
+		opt.OriginMatchMask = ^uint64(0)
+	}
+	return nil
+}
+
+// A query holds the state of a single NTP request/response exchange.
+type query struct {
+	opt      *QueryOptions
+	auth     AuthOptions
+	authKey  []byte
+	xmitHdr  header
+	xmitBuf  []byte
+	xmitTime time.Time
+	recvBuf  []byte
+	recvTime time.Time
+	recvHdr  *header
+	dst      ntpTime
+	authErr  error
+	trailing []byte
+	remote   net.Addr
+}
+
+// newQuery composes a client query message using the provided options.
+func newQuery(opt *QueryOptions) (*query, error) {
+	q := &query{opt: opt}
 
 	// Allocate the query message header.
-	xmitHdr := new(header)
-	xmitHdr.setMode(client)
-	xmitHdr.setVersion(opt.Version)
-	xmitHdr.setLeap(LeapNoWarning)
-	xmitHdr.Precision = 0x20
+	q.xmitHdr.setMode(ModeClient)
+	q.xmitHdr.setVersion(opt.Version)
+	q.xmitHdr.setLeap(LeapNoWarning)
+	q.xmitHdr.Precision = 0x20
 
 	// To help prevent spoofing and client fingerprinting, use a
 	// cryptographically random 64-bit value for the TransmitTime. See:
 	// https://www.ietf.org/archive/id/draft-ietf-ntp-data-minimization-04.txt
 	bits := make([]byte, 8)
-	_, err = rand.Read(bits)
+	_, err := rand.Read(bits)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	xmitHdr.TransmitTime = ntpTime(binary.BigEndian.Uint64(bits))
+	q.xmitHdr.TransmitTime = ntpTime(binary.BigEndian.Uint64(bits))
 
 	// Write the query header to a transmit buffer.
 	var xmitBuf bytes.Buffer
-	binary.Write(&xmitBuf, binary.BigEndian, xmitHdr)
+	binary.Write(&xmitBuf, binary.BigEndian, &q.xmitHdr)
 
 	// Allow extensions to process the query and add to the transmit buffer.
 	for _, e := range opt.Extensions {
 		err = e.ProcessQuery(&xmitBuf)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
+		}
+	}
+
+	// Attach the client identifier if requested.
+	if opt.ClientID != "" {
+		if len(opt.ClientID) > maxClientIDLen {
+			return nil, fmt.Errorf("client ID exceeds %d bytes", maxClientIDLen)
 		}
+		appendExtensionField(&xmitBuf, ClientIDFieldType, []byte(opt.ClientID))
 	}
 
 	// If using symmetric key authentication, decode and validate the auth key
-	// string.
-	authKey, err := decodeAuthKey(opt.Auth)
+	// string unless it was prepared in advance.
+	q.auth, q.authKey, err = authSettings(opt)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// Append a MAC if authentication is being used.
-	appendMAC(&xmitBuf, opt.Auth, authKey)
+	appendMAC(&xmitBuf, q.auth, q.authKey)
 
-	// Transmit the query and keep track of when it was transmitted.
-	xmitTime := time.Now()
-	_, err = con.Write(xmitBuf.Bytes())
-	if err != nil {
-		return nil, 0, err
+	q.xmitBuf = xmitBuf.Bytes()
+	return q, nil
+}
+
+// appendExtensionField appends an RFC 7822 extension field with the given
+// type and value to the buffer. The value is zero-padded to a multiple of 4
+// bytes, and the field is padded to at least 28 bytes so that it can't be
+// mistaken for a MAC when no MAC follows it.
+func appendExtensionField(buf *bytes.Buffer, fieldType uint16, value []byte) {
+	const minFieldLen = 28
+	length := (4 + len(value) + 3) &^ 3
+	if length < minFieldLen {
+		length = minFieldLen
 	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:], fieldType)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(length))
+	buf.Write(hdr[:])
+	buf.Write(value)
+	buf.Write(make([]byte, length-4-len(value)))
+}
 
-	// Receive the response.
-	recvBytes, err := con.Read(recvBuf)
+// An ExtensionField is an NTPv4 extension field (RFC 7822) found in a
+// server's response.
+type ExtensionField struct {
+	// Type is the field type.
+	Type uint16
+
+	// Data is the field's value, including any padding, but not the 4-byte
+	// type and length header.
+	Data []byte
+}
+
+// parseExtensionFields parses the extension fields in the data following
+// an NTP header. Parsing stops at the first data that isn't a well-formed
+// extension field.
+func parseExtensionFields(buf []byte) []ExtensionField {
+	const minFieldLen = 16 // RFC 7822 section 3
+
+	var fields []ExtensionField
+	for len(buf) >= minFieldLen {
+		// A legacy MAC is 20 or 24 bytes long. Because the last extension
+		// field of a packet without a MAC is at least 28 bytes long (RFC
+		// 7822 section 7.5), remaining data of this length must be a MAC.
+		if len(buf) == 20 || len(buf) == 24 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[2:]))
+		if length < minFieldLen || length%4 != 0 || length > len(buf) {
+			break
+		}
+		fields = append(fields, ExtensionField{
+			Type: binary.BigEndian.Uint16(buf[0:]),
+			Data: buf[4:length:length],
+		})
+		buf = buf[length:]
+	}
+	return fields
+}
+
+// originMatches returns true if the origin timestamp org echoes the query's
+// transmit time, ignoring any bits excluded by the OriginMatchMask option.
+func (q *query) originMatches(org ntpTime) bool {
+	mask := ntpTime(q.opt.OriginMatchMask)
+	return org&mask == q.xmitHdr.TransmitTime&mask
+}
+
+// acceptsVersion returns true if the AcceptVersions option permits the
+// response protocol version v.
+func (q *query) acceptsVersion(v int) bool {
+	if len(q.opt.AcceptVersions) == 0 {
+		return true
+	}
+	for _, a := range q.opt.AcceptVersions {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResponse performs sanity checks on the header of the server's
+// response.
+func (q *query) checkResponse(recvHdr *header) error {
+	if recvHdr.getMode() != ModeServer {
+		return ErrInvalidMode
+	}
+	if recvHdr.TransmitTime == ntpTime(0) {
+		return ErrInvalidTransmitTime
+	}
+	if !q.originMatches(recvHdr.OriginTime) {
+		if q.opt.OnOriginMismatch != nil {
+			q.opt.OnOriginMismatch(uint64(q.xmitHdr.TransmitTime), uint64(recvHdr.OriginTime))
+		}
+		return ErrServerResponseMismatch
+	}
+
+	// The server's receive time may exceed its transmit time by no more
+	// than the tolerance. The difference is computed in raw NTP units so
+	// that it remains valid across an era rollover.
+	var tol int64
+	if q.opt.ClockTickTolerance > 0 {
+		tol = int64(q.opt.ClockTickTolerance.Seconds() * (1 << 32))
+	}
+	if over := int64(recvHdr.ReceiveTime - recvHdr.TransmitTime); over > tol {
+		return fmt.Errorf("%w by %v", ErrServerTickedBackwards, ntpTime(over).Duration())
+	}
+	return nil
+}
+
+// addrIP returns the IP address of the network address addr, or nil if it
+// doesn't have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		return nil, 0, err
+		return nil
 	}
+	return net.ParseIP(host)
+}
 
+// originTime returns the origin timestamp of the NTP message in buf. It
+// returns false if the message is too short to contain one.
+func originTime(buf []byte) (ntpTime, bool) {
+	const originOffset = 24
+	if len(buf) < originOffset+8 {
+		return 0, false
+	}
+	return ntpTime(binary.BigEndian.Uint64(buf[originOffset:])), true
+}
+
+// parseResponse parses and checks the server's response to the query. The
+// response header, along with the local system time it was received, are
+// recorded in the query. Authentication failures are recorded in the query
+// rather than returned as an error.
+func (q *query) parseResponse(recvBuf []byte) error {
 	// Keep track of the time the response was received. As of go 1.9, the
 	// time package uses a monotonic clock, so delta will never be less than
 	// zero for go version 1.9 or higher.
-	delta := time.Since(xmitTime)
+	delta := time.Since(q.xmitTime)
 	if delta < 0 {
 		delta = 0
 	}
-	recvTime := xmitTime.Add(delta)
+	q.recvTime = q.xmitTime.Add(delta)
+	q.recvBuf = recvBuf
+
+	// Reject oversized responses before processing them.
+	if len(recvBuf) > q.opt.MaxResponseSize {
+		return ErrResponseTooLarge
+	}
+
+	// Reject responses from unexpected sources. For a connected query, the
+	// remote address is the address that was dialed. Queries over packet
+	// connections skip datagrams from unexpected sources before they get
+	// here.
+	if q.opt.ExpectRemoteAddr != nil && !addrIP(q.remote).Equal(q.opt.ExpectRemoteAddr) {
+		return ErrUnexpectedSource
+	}
 
 	// Parse the response header.
-	recvBuf = recvBuf[:recvBytes]
+	recvHdr := new(header)
 	recvReader := bytes.NewReader(recvBuf)
-	err = binary.Read(recvReader, binary.BigEndian, recvHdr)
+	err := binary.Read(recvReader, binary.BigEndian, recvHdr)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
+	q.recvHdr = recvHdr
+	q.dst = toNtpTime(q.recvTime)
 
 	// Allow extensions to process the response.
-	for i := len(opt.Extensions) - 1; i >= 0; i-- {
-		err = opt.Extensions[i].ProcessResponse(recvBuf)
+	for i := len(q.opt.Extensions) - 1; i >= 0; i-- {
+		err = q.opt.Extensions[i].ProcessResponse(recvBuf)
 		if err != nil {
-			return nil, 0, err
+			return err
 		}
 	}
 
 	// Check for invalid fields.
-	if recvHdr.getMode() != server {
-		return nil, 0, ErrInvalidMode
-	}
-	if recvHdr.TransmitTime == ntpTime(0) {
-		return nil, 0, ErrInvalidTransmitTime
-	}
-	if recvHdr.OriginTime != xmitHdr.TransmitTime {
-		return nil, 0, ErrServerResponseMismatch
+	if !q.opt.SkipInternalChecks {
+		err = q.checkResponse(recvHdr)
+		if err != nil {
+			return err
+		}
 	}
-	if recvHdr.ReceiveTime > recvHdr.TransmitTime {
-		return nil, 0, ErrServerTickedBackwards
+	if !q.acceptsVersion(recvHdr.getVersion()) {
+		return ErrVersionMismatch
 	}
 
 	// Correct the received message's origin time using the actual
 	// transmit time.
-	recvHdr.OriginTime = toNtpTime(xmitTime)
+	recvHdr.OriginTime = toNtpTime(q.xmitTime)
 
 	// Perform authentication of the server response.
-	authErr := verifyMAC(recvBuf, opt.Auth, authKey)
+	q.authErr = verifyMAC(recvBuf, q.auth, q.authKey)
+
+	// Preserve any data following the header, less the verified MAC.
+	end := len(recvBuf)
+	if q.auth.Type != AuthNone && q.authErr == nil {
+		end -= 4 + algorithms[q.auth.Type].DigestSize
+	}
+	if end > headerSize {
+		q.trailing = recvBuf[headerSize:end:end]
+	}
+
+	return nil
+}
 
-	return recvHdr, toNtpTime(recvTime), authErr
+// authSettings returns the symmetric key authentication options and the
+// decoded key to use for the query options.
+func authSettings(opt *QueryOptions) (AuthOptions, []byte, error) {
+	if opt.PreparedAuth != nil {
+		return opt.PreparedAuth.opt, opt.PreparedAuth.key, nil
+	}
+	key, err := decodeAuthKey(opt.Auth)
+	return opt.Auth, key, err
+}
+
+// parseUnsolicited parses a packet received without a matching query. It
+// returns nil if the packet isn't a valid server or broadcast packet
+// acceptable under the query options.
+func parseUnsolicited(buf []byte, from net.Addr, recvTime time.Time, opt *QueryOptions, auth AuthOptions, key []byte) *Response {
+	if len(buf) < headerSize || len(buf) > opt.MaxResponseSize {
+		return nil
+	}
+	if opt.ExpectRemoteAddr != nil && !addrIP(from).Equal(opt.ExpectRemoteAddr) {
+		return nil
+	}
+
+	h := new(header)
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, h)
+	if mode := h.getMode(); mode != ModeServer && mode != ModeBroadcast {
+		return nil
+	}
+	if h.TransmitTime == 0 {
+		return nil
+	}
+	q := query{opt: opt}
+	if !q.acceptsVersion(h.getVersion()) {
+		return nil
+	}
+	for i := len(opt.Extensions) - 1; i >= 0; i-- {
+		if opt.Extensions[i].ProcessResponse(buf) != nil {
+			return nil
+		}
+	}
+
+	// Without a query, the round trip can't be measured. Assume the packet
+	// arrived with no delay, as a broadcast client does, by treating the
+	// server's transmit time as its receive time and the local receive
+	// time as the origin time.
+	dst := toNtpTime(recvTime)
+	h.OriginTime = dst
+	h.ReceiveTime = h.TransmitTime
+
+	authErr := verifyMAC(buf, auth, key)
+	r := generateResponse(h, dst, authErr)
+	decodeServerTimes(r, h, opt)
+	r.authenticated = auth.Type != AuthNone
+	r.RemoteAddr = from
+	r.RawResponse = buf
+	r.RecvInstant = recvTime
+
+	end := len(buf)
+	if auth.Type != AuthNone && authErr == nil {
+		end -= 4 + algorithms[auth.Type].DigestSize
+	}
+	if end > headerSize {
+		r.TrailingBytes = buf[headerSize:end:end]
+		r.ExtensionFields = parseExtensionFields(r.TrailingBytes)
+	}
+	return r
+}
+
+// optionError reports that the named socket option couldn't be applied to
+// the connection. The returned error wraps ErrOptionUnsupported.
+func optionError(option string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrOptionUnsupported, option, err)
+}
+
+// dontRoute enables the SO_DONTROUTE socket option on the connection.
+func dontRoute(con net.Conn) error {
+	sc, ok := con.(syscall.Conn)
+	if !ok {
+		return errors.New("connection has no underlying socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setDontRoute(rc)
 }
 
 // defaultDialer provides a UDP dialer based on Go's built-in net stack.
 func defaultDialer(localAddress, remoteAddress string) (net.Conn, error) {
-	var laddr *net.UDPAddr
-	if localAddress != "" {
-		var err error
-		laddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(localAddress, "0"))
-		if err != nil {
-			return nil, err
-		}
+	laddr, err := localUDPAddr(localAddress)
+	if err != nil {
+		return nil, err
 	}
 
 	raddr, err := net.ResolveUDPAddr("udp", remoteAddress)
@@ -646,6 +2805,67 @@ func defaultDialer(localAddress, remoteAddress string) (net.Conn, error) {
 	return net.DialUDP("udp", laddr, raddr)
 }
 
+// resolvingDialer returns a UDP dialer that uses the resolver to look up the
+// remote host name.
+func resolvingDialer(res Resolver) func(localAddress, remoteAddress string) (net.Conn, error) {
+	return func(localAddress, remoteAddress string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(remoteAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		// Zoned IPv6 literals can only be handled by the built-in resolver.
+		if strings.IndexByte(host, '%') >= 0 {
+			return defaultDialer(localAddress, remoteAddress)
+		}
+
+		laddr, err := localUDPAddr(localAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := lookupHost(res, host)
+		if err != nil {
+			return nil, err
+		}
+		rport, err := net.LookupPort("udp", port)
+		if err != nil {
+			return nil, err
+		}
+
+		return net.DialUDP("udp", laddr, &net.UDPAddr{IP: ips[0], Port: rport})
+	}
+}
+
+// localUDPAddr resolves the optional local address used to create a UDP
+// connection.
+func localUDPAddr(localAddress string) (*net.UDPAddr, error) {
+	if localAddress == "" {
+		return nil, nil
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(localAddress, "0"))
+}
+
+// lookupHost returns the IP addresses of the host using the resolver, or
+// using Go's built-in resolver if res is nil. IP address literals are
+// returned without consulting the resolver.
+func lookupHost(res Resolver, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	ips, err := res.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
 // dialWrapper is used to wrap the deprecated Dial callback in QueryOptions.
 func dialWrapper(la, ra string,
 	dial func(la string, lp int, ra string, rp int) (net.Conn, error)) (net.Conn, error) {
@@ -710,7 +2930,9 @@ func generateResponse(h *header, recvTime ntpTime, authErr error) *Response {
 		ClockOffset:    offset(h.OriginTime, h.ReceiveTime, h.TransmitTime, recvTime),
 		RTT:            rtt(h.OriginTime, h.ReceiveTime, h.TransmitTime, recvTime),
 		Precision:      toInterval(h.Precision),
+		PrecisionExp:   h.Precision,
 		Version:        h.getVersion(),
+		Mode:           h.getMode(),
 		Stratum:        h.Stratum,
 		ReferenceID:    h.ReferenceID,
 		ReferenceTime:  h.ReferenceTime.Time(),
@@ -720,20 +2942,39 @@ func generateResponse(h *header, recvTime ntpTime, authErr error) *Response {
 		MinError:       minError(h.OriginTime, h.ReceiveTime, h.TransmitTime, recvTime),
 		Poll:           toInterval(h.Poll),
 		authErr:        authErr,
+		lvm:            h.LiVnMode,
+		org:            h.OriginTime,
+		rec:            h.ReceiveTime,
+		xmt:            h.TransmitTime,
+		dst:            recvTime,
 	}
 
 	// Calculate values depending on other calculated values
 	r.RootDistance = rootDistance(r.RTT, r.RootDelay, r.RootDispersion)
+	r.OutboundDelay = r.RTT / 2
+	r.InboundDelay = r.RTT - r.OutboundDelay
 
 	// If a kiss of death was received, interpret the reference ID as
 	// a kiss code.
 	if r.Stratum == 0 {
 		r.KissCode = kissCode(r.ReferenceID)
+		r.UnknownKiss = r.KissCode != "" && !knownKissCodes[r.KissCode]
 	}
 
 	return r
 }
 
+// decodeServerTimes decodes the response's Time and ReferenceTime fields
+// from the server's timestamps in the response header h using the EraPivot
+// option, if set. Otherwise generateResponse's decoding is retained.
+func decodeServerTimes(r *Response, h *header, opt *QueryOptions) {
+	if opt.EraPivot.IsZero() {
+		return
+	}
+	r.Time = h.TransmitTime.timeAfter(opt.EraPivot)
+	r.ReferenceTime = h.ReferenceTime.timeAfter(opt.EraPivot)
+}
+
 // The following helper functions calculate additional metadata about the
 // timestamps received from an NTP server.  The timestamps returned by
 // the server are given the following variable names:
@@ -753,6 +2994,14 @@ func rtt(org, rec, xmt, dst ntpTime) time.Duration {
 	return ntpTime(rtt).Duration()
 }
 
+// offsetFloat returns the clock offset in seconds, without rounding it to
+// the nanosecond precision of time.Duration.
+func offsetFloat(org, rec, xmt, dst ntpTime) float64 {
+	a := int64(rec - org)
+	b := int64(xmt - dst)
+	return (float64(a) + float64(b)) / 2 / (1 << 32)
+}
+
 func offset(org, rec, xmt, dst ntpTime) time.Duration {
 	// The inputs are 64-bit unsigned integer timestamps. These timestamps can
 	// "roll over" at the end of an NTP era, which occurs approximately every
@@ -765,7 +3014,16 @@ func offset(org, rec, xmt, dst ntpTime) time.Duration {
 
 	a := int64(rec - org)
 	b := int64(xmt - dst)
-	offset := a + (b-a)/2
+
+	// The offset is the mean of a and b. Compute it without overflowing,
+	// and round halfway cases to the nearest even value. Truncating would
+	// bias the result, and the bias accumulates when many samples are
+	// aggregated.
+	d := b - a
+	offset := a + d>>1
+	if d&1 != 0 && offset&1 != 0 {
+		offset++
+	}
 	if offset < 0 {
 		return -ntpTime(-offset).Duration()
 	}
@@ -807,6 +3065,25 @@ func rootDistance(rtt, rootDelay, rootDisp time.Duration) time.Duration {
 	return totalDelay/2 + rootDisp
 }
 
+// PollExponent returns the NTP poll exponent whose interval (2^exp seconds)
+// is nearest to the given interval, measured on a logarithmic scale. The
+// exponent is clamped to the range 4 (16 seconds) to 17 (~36 hours)
+// permitted for poll intervals by RFC 5905.
+func PollExponent(interval time.Duration) int8 {
+	if interval <= 0 {
+		return minPoll
+	}
+	exp := math.Round(math.Log2(interval.Seconds()))
+	exp = math.Max(minPoll, math.Min(maxPoll, exp))
+	return int8(exp)
+}
+
+// PollInterval returns the interval represented by the NTP poll exponent
+// exp, which is 2^exp seconds. It is the inverse of PollExponent.
+func PollInterval(exp int8) time.Duration {
+	return toInterval(exp)
+}
+
 func toInterval(t int8) time.Duration {
 	switch {
 	case t > 0:
@@ -5,10 +5,19 @@
 package ntp
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -90,6 +99,204 @@ func stringOrEmpty(s string) string {
 	return s
 }
 
+// makeReply builds a valid server response to the client query q. If modify
+// is not nil, it may alter the response header before it is encoded.
+func makeReply(q []byte, modify func(h *header)) []byte {
+	var qh header
+	binary.Read(bytes.NewReader(q), binary.BigEndian, &qh)
+
+	now := toNtpTime(time.Now())
+	h := header{
+		Stratum:       1,
+		ReferenceID:   refID,
+		ReferenceTime: now,
+		OriginTime:    qh.TransmitTime,
+		ReceiveTime:   now,
+		TransmitTime:  now,
+	}
+	h.setMode(ModeServer)
+	h.setVersion(qh.getVersion())
+	if modify != nil {
+		modify(&h)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	return buf.Bytes()
+}
+
+// timeoutError is a net.Error reporting an i/o timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// A datagram is a packet delivered by a fakePacketConn.
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// fakePacketConn is a net.PacketConn that answers each query written to it
+// with the datagrams returned by its reply callback. Once all queued
+// datagrams have been read, reads fail with a timeout error.
+type fakePacketConn struct {
+	reply   func(q []byte, addr net.Addr) []datagram
+	queue   []datagram
+	written []datagram
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.queue) == 0 {
+		return 0, nil, timeoutError{}
+	}
+	d := c.queue[0]
+	c.queue = c.queue[1:]
+	return copy(p, d.data), d.addr, nil
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	q := append([]byte(nil), p...)
+	c.written = append(c.written, datagram{q, addr})
+	c.queue = append(c.queue, c.reply(q, addr)...)
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error                       { return nil }
+func (c *fakePacketConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// fakeConn is a net.Conn that answers each query written to it with the
+// datagrams returned by its reply callback.
+type fakeConn struct {
+	fakePacketConn
+	raddr net.Addr
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.raddr)
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// fakeDialer returns a Dialer callback producing fakeConn connections that
+// answer queries using the reply callback.
+func fakeDialer(reply func(q []byte, addr net.Addr) []datagram) func(la, ra string) (net.Conn, error) {
+	return func(la, ra string) (net.Conn, error) {
+		raddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+		return &fakeConn{fakePacketConn{reply: reply}, raddr}, nil
+	}
+}
+
+// fakeResolver is a Resolver that returns a fixed set of addresses and
+// records the hosts it was asked to look up.
+type fakeResolver struct {
+	mu    sync.Mutex
+	ips   []net.IP
+	hosts []string
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+	return r.ips, nil
+}
+
+// startServer starts a local UDP server that answers each query using the
+// reply callback. It returns the server's address. The server is stopped
+// when the test completes.
+func startServer(t *testing.T, reply func(q []byte) [][]byte) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, r := range reply(buf[:n]) {
+				conn.WriteToUDP(r, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestOfflineQueryWithContext(t *testing.T) {
+	// A server that never replies.
+	silent := startServer(t, func(q []byte) [][]byte { return nil }).String()
+	opt := QueryOptions{Timeout: 5 * time.Second}
+
+	// Cancellation aborts the read.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	r, err := QueryWithContext(ctx, silent, opt)
+	assert.Nil(t, r)
+	assert.Equal(t, context.Canceled, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The context's deadline applies when it precedes the timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = QueryWithContext(ctx, silent, opt)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, ClassTimeout, ClassifyError(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The timeout applies when it precedes the context's deadline.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = QueryWithContext(ctx, silent, QueryOptions{Timeout: 20 * time.Millisecond})
+	assert.NotNil(t, err)
+	assert.NotEqual(t, context.DeadlineExceeded, err)
+	assert.Equal(t, ClassTimeout, ClassifyError(err))
+
+	// A cancelled context fails before dialing.
+	dialed := false
+	opt.Dialer = func(la, ra string) (net.Conn, error) {
+		dialed = true
+		return nil, errors.New("unexpected dial")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = QueryWithContext(ctx, silent, opt)
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, dialed)
+
+	// A context-aware dialer receives the query's context.
+	type key struct{}
+	ctx = context.WithValue(context.Background(), key{}, "value")
+	dial := fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	opt.DialerContext = func(ctx context.Context, la, ra string) (net.Conn, error) {
+		assert.Equal(t, "value", ctx.Value(key{}))
+		return dial(la, ra)
+	}
+	r, err = QueryWithContext(ctx, "remote", opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.False(t, dialed)
+}
+
 func TestOnlineBadServerPort(t *testing.T) {
 	// Not NTP port.
 	tm, _, err := getTime(host+":9", &QueryOptions{Timeout: 1 * time.Second})
@@ -459,6 +666,160 @@ func TestOfflineTimeRollover(t *testing.T) {
 	}
 }
 
+func TestOfflineNTPTimeEra(t *testing.T) {
+	cases := []struct {
+		time  string
+		value uint64
+		era   int
+	}{
+		{"1899-12-31 23:59:59", 0xffffffff00000000, -1},
+		{"1900-01-01 00:00:00", 0x0000000000000000, 0},
+		{"1970-01-01 00:00:00", 0x83aa7e8000000000, 0},
+		{"2036-02-07 06:28:15", 0xffffffff00000000, 0},
+		{"2036-02-07 06:28:16", 0x0000000000000000, 1},
+		{"2036-02-07 06:28:17", 0x0000000100000000, 1},
+		{"2106-02-07 06:28:16", 0x83aa7e8000000000, 1},
+		{"2172-03-15 12:56:32", 0x0000000000000000, 2},
+	}
+
+	timeFormat := "2006-01-02 15:04:05"
+
+	for _, c := range cases {
+		tm, _ := time.Parse(timeFormat, c.time)
+		v, era := ToNTPTime(tm)
+		assert.Equal(t, c.value, v, c.time)
+		assert.Equal(t, c.era, era, c.time)
+		assert.Equal(t, tm, FromNTPTime(v, era), c.time)
+	}
+
+	// Round-trip sub-second times on either side of the 2036 boundary.
+	for _, d := range []time.Duration{-1500 * time.Millisecond, -1, 0, 1, 250 * time.Millisecond} {
+		tm := ntpEra1.Add(d)
+		v, era := ToNTPTime(tm)
+		assert.Equal(t, tm, FromNTPTime(v, era), d.String())
+	}
+}
+
+func TestOfflineValidateEraFreshness(t *testing.T) {
+	cases := []struct {
+		ref, xmt string
+		fresh    bool
+	}{
+		// An era 1 server.
+		{"2040-06-01 12:00:00", "2040-06-01 13:00:00", true},
+		{"2040-06-01 12:00:00", "2040-06-05 12:00:00", false},
+
+		// A server whose reference time precedes the era rollover.
+		{"2036-02-07 06:00:00", "2036-02-07 07:00:00", true},
+		{"2036-02-05 06:00:00", "2036-02-07 07:00:00", false},
+	}
+
+	timeFormat := "2006-01-02 15:04:05"
+	for _, c := range cases {
+		ref, _ := time.Parse(timeFormat, c.ref)
+		xmt, _ := time.Parse(timeFormat, c.xmt)
+		h := header{
+			Stratum:       2,
+			ReferenceTime: toNtpTime(ref),
+			OriginTime:    toNtpTime(xmt),
+			ReceiveTime:   toNtpTime(xmt),
+			TransmitTime:  toNtpTime(xmt),
+		}
+		r := generateResponse(&h, toNtpTime(xmt), nil)
+		assert.Equal(t, ref, r.ReferenceTime, c.ref)
+		assert.Equal(t, xmt, r.Time, c.xmt)
+
+		err := r.Validate()
+		if c.fresh {
+			assert.Nil(t, err, c.xmt)
+		} else {
+			assert.Equal(t, ErrServerClockFreshness, err, c.xmt)
+		}
+	}
+}
+
+func TestOfflineFromNTPTimeAfter(t *testing.T) {
+	timeFormat := "2006-01-02 15:04:05"
+	parse := func(s string) time.Time {
+		tm, _ := time.Parse(timeFormat, s)
+		return tm
+	}
+
+	cases := []struct {
+		value uint64
+		pivot string
+		time  string
+	}{
+		// The default pivot used for responses.
+		{0x83aa7e8000000000, "1970-01-01 00:00:00", "1970-01-01 00:00:00"},
+		{0x83aa7e7f00000000, "1970-01-01 00:00:00", "2106-02-07 06:28:15"},
+		{0x0000000000000000, "1970-01-01 00:00:00", "2036-02-07 06:28:16"},
+		{0xffffffff00000000, "1970-01-01 00:00:00", "2036-02-07 06:28:15"},
+
+		// A pivot in era 1.
+		{0x83aa7e8000000000, "2100-01-01 00:00:00", "2106-02-07 06:28:16"},
+		{0xffffffff00000000, "2100-01-01 00:00:00", "2172-03-15 12:56:31"},
+
+		// A pivot before 1900.
+		{0xffffffff00000000, "1850-01-01 00:00:00", "1899-12-31 23:59:59"},
+		{0x0000000000000000, "1850-01-01 00:00:00", "1900-01-01 00:00:00"},
+	}
+	for _, c := range cases {
+		tm := FromNTPTimeAfter(c.value, parse(c.pivot))
+		assert.Equal(t, parse(c.time), tm, c.time)
+	}
+
+	// Response times are decoded with the default pivot.
+	for _, c := range cases[:4] {
+		assert.Equal(t, parse(c.time), ntpTime(c.value).Time(), c.time)
+	}
+}
+
+func TestOfflineEraPivot(t *testing.T) {
+	timeFormat := "2006-01-02 15:04:05"
+	parse := func(s string) time.Time {
+		tm, _ := time.Parse(timeFormat, s)
+		return tm
+	}
+
+	// A server set far in the future.
+	var xmt ntpTime
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.ReferenceTime = 0x83aa7e8000000000
+				h.ReceiveTime = xmt
+				h.TransmitTime = xmt
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	xmt = 0xffffffff00000000
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, parse("2036-02-07 06:28:15"), r.Time)
+	assert.Equal(t, parse("1970-01-01 00:00:00"), r.ReferenceTime)
+
+	opt.EraPivot = parse("2100-01-01 00:00:00")
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, parse("2172-03-15 12:56:31"), r.Time)
+	assert.Equal(t, parse("2106-02-07 06:28:16"), r.ReferenceTime)
+
+	// The pivot also applies to the response reported with a detailed
+	// error.
+	xmt = 0
+	opt.DetailedErrors = true
+	_, err = QueryWithOptions("remote", opt)
+	var qerr *QueryError
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Equal(t, ErrInvalidTransmitTime, qerr.Err)
+		assert.Equal(t, parse("2172-03-15 12:56:32"), qerr.Response.Time)
+		assert.Equal(t, parse("2106-02-07 06:28:16"), qerr.Response.ReferenceTime)
+	}
+}
+
 func TestOfflineReferenceString(t *testing.T) {
 	cases := []struct {
 		Stratum byte
@@ -557,3 +918,2052 @@ func TestOfflineValidate(t *testing.T) {
 	assert.Equal(t, r.RTT, 0*time.Second)
 	assert.Equal(t, r.RootDistance, 8*time.Second)
 }
+
+func TestOfflineServerProcessingDelay(t *testing.T) {
+	start := time.Now()
+	h := &header{
+		Stratum:       1,
+		ReferenceID:   refID,
+		ReferenceTime: toNtpTime(start),
+		OriginTime:    toNtpTime(start.Add(1 * time.Second)),
+		ReceiveTime:   toNtpTime(start.Add(2 * time.Second)),
+		TransmitTime:  toNtpTime(start.Add(2*time.Second + 250*time.Millisecond)),
+	}
+	r := generateResponse(h, toNtpTime(start.Add(4*time.Second)), nil)
+	assert.Equal(t, 250*time.Millisecond, r.ServerProcessingDelay())
+
+	h.TransmitTime = h.ReceiveTime
+	r = generateResponse(h, toNtpTime(start.Add(4*time.Second)), nil)
+	assert.Equal(t, time.Duration(0), r.ServerProcessingDelay())
+}
+
+func TestOfflineQueryPacketConn(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123}
+
+	// Deliver a stale reply from another peer, a runt datagram and a reply
+	// to some other query before delivering the matching reply.
+	conn := &fakePacketConn{
+		reply: func(q []byte, addr net.Addr) []datagram {
+			stale := makeReply(q, func(h *header) { h.OriginTime++ })
+			unrelated := makeReply(q, func(h *header) { h.Stratum = 3 })
+			match := makeReply(q, func(h *header) { h.Stratum = 2 })
+			copy(unrelated[24:32], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+			return []datagram{{stale, other}, {[]byte{0x24}, addr}, {unrelated, addr}, {match, addr}}
+		},
+	}
+
+	r, err := QueryPacketConn(conn, peer, QueryOptions{})
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, uint8(2), r.Stratum)
+	assert.Equal(t, peer, r.RemoteAddr)
+	assert.Equal(t, 1, len(conn.written))
+	assert.Equal(t, peer, conn.written[0].addr)
+
+	// No matching reply should result in a timeout.
+	conn.reply = func(q []byte, addr net.Addr) []datagram {
+		stale := makeReply(q, func(h *header) { h.OriginTime++ })
+		return []datagram{{stale, addr}}
+	}
+	r, err = QueryPacketConn(conn, peer, QueryOptions{})
+	assert.Nil(t, r)
+	assert.Equal(t, timeoutError{}, err)
+}
+
+func TestOfflineExpectRemoteAddr(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	spoofer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 123}
+
+	// An off-path attacker injects a reply echoing the query's transmit
+	// time. It is ignored, and the query times out.
+	conn := &fakePacketConn{
+		reply: func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), spoofer}}
+		},
+	}
+	opt := QueryOptions{ExpectRemoteAddr: peer.IP}
+	r, err := QueryPacketConn(conn, peer, opt)
+	assert.Nil(t, r)
+	assert.Equal(t, timeoutError{}, err)
+
+	// A spoofed reply arriving before the genuine one doesn't prevent the
+	// genuine reply from being accepted.
+	conn.reply = func(q []byte, addr net.Addr) []datagram {
+		spoofed := makeReply(q, func(h *header) { h.Stratum = 3 })
+		genuine := makeReply(q, func(h *header) { h.Stratum = 2 })
+		return []datagram{{spoofed, spoofer}, {genuine, addr}}
+	}
+	r, err = QueryPacketConn(conn, peer, opt)
+	assert.Nil(t, err)
+	assert.Equal(t, peer, r.RemoteAddr)
+	assert.Equal(t, uint8(2), r.Stratum)
+
+	responses, errs := QueryManyPacketConn(conn, []net.Addr{peer}, opt)
+	assert.Nil(t, errs[0])
+	assert.Equal(t, uint8(2), responses[0].Stratum)
+
+	// On a connected query, the dialed address is checked.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	opt.ExpectRemoteAddr = spoofer.IP
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrUnexpectedSource, err)
+	assert.Equal(t, ClassInvalidResponse, ClassifyError(err))
+}
+
+func TestOfflineQueryManyPacketConn(t *testing.T) {
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 4), Port: 123},
+	}
+
+	// Hold the replies until the third query is sent, then deliver them in
+	// reverse order along with a stray datagram. Each server reports a
+	// distinct stratum. The fourth server never replies.
+	var held []datagram
+	conn := &fakePacketConn{
+		reply: func(q []byte, addr net.Addr) []datagram {
+			for i, a := range addrs[:3] {
+				if a == addr {
+					stratum := uint8(i + 1)
+					reply := makeReply(q, func(h *header) { h.Stratum = stratum })
+					held = append([]datagram{{reply, addr}}, held...)
+				}
+			}
+			if len(held) < 3 {
+				return nil
+			}
+			stray := makeReply(q, func(h *header) { h.OriginTime++ })
+			out := append([]datagram{{stray, addrs[0]}}, held...)
+			held = nil
+			return out
+		},
+	}
+
+	responses, errs := QueryManyPacketConn(conn, addrs, QueryOptions{})
+	assert.Equal(t, 4, len(conn.written))
+	assert.Equal(t, 4, len(responses))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, errs[i])
+		assert.Equal(t, uint8(i+1), responses[i].Stratum)
+		assert.Equal(t, addrs[i], responses[i].RemoteAddr)
+	}
+	assert.Nil(t, responses[3])
+	assert.Equal(t, timeoutError{}, errs[3])
+
+	// Each query used a distinct transmit time.
+	seen := make(map[uint64]bool)
+	for _, d := range conn.written {
+		seen[binary.BigEndian.Uint64(d.data[40:])] = true
+	}
+	assert.Equal(t, 4, len(seen))
+}
+
+func TestOfflineQueryBest(t *testing.T) {
+	// The server's replies are delayed by varying amounts. The first reply
+	// also reports a clock running 10ms behind the client's, violating
+	// causality. Each reply reports a distinct stratum.
+	delays := []time.Duration{30 * time.Millisecond, 0, 15 * time.Millisecond}
+	var n int32
+	addr := startServer(t, func(q []byte) [][]byte {
+		i := int(atomic.AddInt32(&n, 1)) - 1
+		time.Sleep(delays[i])
+		return [][]byte{makeReply(q, func(h *header) {
+			h.Stratum = uint8(i + 1)
+			if i == 0 {
+				behind := toNtpTime(time.Now().Add(-delays[0] - 10*time.Millisecond))
+				h.ReferenceTime = behind
+				h.ReceiveTime = behind
+				h.TransmitTime = behind
+			}
+		})}
+	})
+
+	opt := QueryOptions{SampleInterval: time.Millisecond}
+	r, err := QueryBest(addr.String(), len(delays), opt)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(len(delays)), atomic.LoadInt32(&n))
+	assert.Equal(t, uint8(2), r.Stratum)
+	assert.Less(t, r.RTT, 15*time.Millisecond)
+	assert.InDelta(t, float64(10*time.Millisecond), float64(r.MinError), float64(5*time.Millisecond))
+
+	// Sampling stops at a kiss of death.
+	queries := 0
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		queries++
+		reply := makeReply(q, func(h *header) {
+			h.Stratum = 0
+			h.ReferenceID = 0x52415445 // RATE
+		})
+		return []datagram{{reply, addr}}
+	})
+	r, err = QueryBest("remote", 4, opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrKissOfDeath, err)
+	assert.Equal(t, 1, queries)
+}
+
+func TestOfflineQueryMany(t *testing.T) {
+	addrs := []string{"a.example", "b.example", "c.example", "d.example"}
+
+	// Each dial waits until all of them have started, which only succeeds
+	// if the queries run concurrently. Each server reports a distinct
+	// stratum, and the third server can't be reached.
+	var started sync.WaitGroup
+	started.Add(len(addrs))
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+
+	opt := QueryOptions{
+		Dialer: func(la, ra string) (net.Conn, error) {
+			started.Done()
+			select {
+			case <-all:
+			case <-time.After(time.Second):
+				return nil, errors.New("queries not concurrent")
+			}
+			host, _, _ := net.SplitHostPort(ra)
+			if host == "c.example" {
+				return nil, errors.New("unreachable")
+			}
+			stratum := host[0] - 'a' + 1
+			return fakeDialer(func(q []byte, addr net.Addr) []datagram {
+				reply := makeReply(q, func(h *header) { h.Stratum = stratum })
+				return []datagram{{reply, addr}}
+			})(la, ra)
+		},
+	}
+
+	responses, errs := QueryMany(addrs, opt)
+	assert.Equal(t, len(addrs), len(responses))
+	assert.Equal(t, len(addrs), len(errs))
+	for i := range addrs {
+		if i == 2 {
+			assert.Nil(t, responses[i])
+			assert.EqualError(t, errs[i], "unreachable")
+			continue
+		}
+		assert.Nil(t, errs[i])
+		assert.Equal(t, uint8(i+1), responses[i].Stratum)
+	}
+
+	responses, errs = QueryMany(nil, opt)
+	assert.Empty(t, responses)
+	assert.Empty(t, errs)
+}
+
+func TestOfflineCollectResponses(t *testing.T) {
+	addr1 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	addr2 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123}
+
+	// packet returns an unsolicited packet sent by a server whose clock is
+	// ahead of the local clock by offset.
+	packet := func(mode Mode, stratum uint8, offset time.Duration) []byte {
+		now := toNtpTime(time.Now().Add(offset))
+		h := header{Stratum: stratum, ReferenceTime: now, TransmitTime: now}
+		h.setMode(mode)
+		h.setVersion(4)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, &h)
+		return buf.Bytes()
+	}
+
+	// Two broadcast packets and a server reply are collected. A client mode
+	// packet and a runt datagram are discarded.
+	conn := &fakePacketConn{
+		queue: []datagram{
+			{packet(ModeBroadcast, 1, time.Hour), addr1},
+			{packet(ModeClient, 2, 0), addr2},
+			{packet(ModeServer, 2, time.Hour), addr2},
+			{[]byte{0x24, 0x01}, addr1},
+			{packet(ModeBroadcast, 1, time.Hour), addr1},
+		},
+	}
+	responses, err := CollectResponses(conn, time.Second, QueryOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(responses))
+	assert.Equal(t, 0, len(conn.written))
+
+	expected := []struct {
+		mode    Mode
+		stratum uint8
+		addr    net.Addr
+	}{
+		{ModeBroadcast, 1, addr1},
+		{ModeServer, 2, addr2},
+		{ModeBroadcast, 1, addr1},
+	}
+	for i, r := range responses {
+		assert.Equal(t, expected[i].mode, r.Mode)
+		assert.Equal(t, expected[i].stratum, r.Stratum)
+		assert.Equal(t, expected[i].addr, r.RemoteAddr)
+		assert.Equal(t, time.Duration(0), r.RTT)
+		assert.InDelta(t, time.Hour, r.ClockOffset, float64(time.Second))
+		assert.Nil(t, r.Validate())
+	}
+
+	// Packets from other sources are discarded.
+	conn.queue = []datagram{
+		{packet(ModeBroadcast, 1, 0), addr1},
+		{packet(ModeBroadcast, 1, 0), addr2},
+	}
+	responses, err = CollectResponses(conn, time.Second, QueryOptions{ExpectRemoteAddr: addr2.IP})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, addr2, responses[0].RemoteAddr)
+
+	// An empty window returns no responses.
+	responses, err = CollectResponses(conn, time.Second, QueryOptions{})
+	assert.Nil(t, err)
+	assert.Nil(t, responses)
+}
+
+func TestOfflineMaxAge(t *testing.T) {
+	cases := []struct {
+		dist     time.Duration
+		budget   time.Duration
+		expected time.Duration
+	}{
+		{0, time.Millisecond, 66666666667},                          // 1ms / 15 PPM
+		{0, 3 * time.Millisecond, 200 * time.Second},                // 3ms / 15 PPM
+		{time.Millisecond, 4 * time.Millisecond, 200 * time.Second}, // 3ms / 15 PPM
+		{time.Millisecond, time.Millisecond, 0},                     // already at budget
+		{10 * time.Millisecond, time.Millisecond, 0},                // over budget
+		{0, 0, 0},
+		{0, 48 * time.Hour, math.MaxInt64}, // saturated
+	}
+	for _, c := range cases {
+		r := SyntheticResponse(0)
+		r.RootDistance = c.dist
+		assert.InDelta(t, float64(c.expected), float64(r.MaxAge(c.budget)), float64(time.Microsecond))
+	}
+}
+
+func TestOfflineUnknownKiss(t *testing.T) {
+	cases := []struct {
+		Stratum byte
+		RefID   uint32
+		Unknown bool
+	}{
+		{0, 0x52415445, false}, // RATE
+		{0, 0x44454e59, false}, // DENY
+		{0, 0x5a5a5a5a, true},  // ZZZZ
+		{0, 0x01010101, false}, // unprintable
+		{1, 0x5a5a5a5a, false}, // not a kiss of death
+	}
+	for _, c := range cases {
+		h := &header{Stratum: c.Stratum, ReferenceID: c.RefID}
+		r := generateResponse(h, 0, nil)
+		assert.Equal(t, c.Unknown, r.UnknownKiss)
+	}
+}
+
+func TestOfflineSyntheticResponse(t *testing.T) {
+	offsets := []time.Duration{0, time.Millisecond, -3 * time.Second, 90 * time.Minute}
+	for _, offset := range offsets {
+		r := SyntheticResponse(offset)
+		assert.Nil(t, r.Validate())
+		assert.Equal(t, offset, r.ClockOffset)
+		assert.Equal(t, uint8(2), r.Stratum)
+		assert.InDelta(t, float64(10*time.Millisecond), float64(r.RTT), float64(time.Microsecond))
+	}
+}
+
+func TestOfflineOnOriginMismatch(t *testing.T) {
+	var sent, echoed uint64
+	calls := 0
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) { h.OriginTime ^= 0xffff })
+			return []datagram{{reply, addr}}
+		}),
+		OnOriginMismatch: func(s, e uint64) {
+			sent, echoed = s, e
+			calls++
+		},
+	}
+
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrServerResponseMismatch, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, sent^0xffff, echoed)
+
+	// The callback must not fire when the origin timestamp matches.
+	calls = 0
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, 0, calls)
+}
+
+func TestOfflineNextPoll(t *testing.T) {
+	start := time.Now()
+	h := &header{
+		Stratum:       1,
+		ReferenceID:   refID,
+		ReferenceTime: toNtpTime(start),
+		OriginTime:    toNtpTime(start),
+		ReceiveTime:   toNtpTime(start),
+		TransmitTime:  toNtpTime(start),
+	}
+	dst := toNtpTime(start)
+
+	cases := []struct {
+		Poll     int8
+		Budget   time.Duration
+		Expected time.Duration
+	}{
+		{4, time.Millisecond, 66666666667},         // 1ms / 15 PPM
+		{10, time.Millisecond, 1024 * time.Second}, // poll hint wins
+		{4, 0, 16 * time.Second},                   // no budget at all
+		{4, 10 * time.Second, maxPollInterval},     // clamped
+		{18, time.Millisecond, maxPollInterval},
+	}
+	for _, c := range cases {
+		h.Poll = c.Poll
+		r := generateResponse(h, dst, nil)
+		next := r.NextPoll(c.Budget)
+		assert.InDelta(t, float64(c.Expected), float64(next.Sub(dst.Time())), float64(time.Microsecond))
+	}
+
+	// A larger root distance shortens the wait.
+	h.Poll = 0
+	h.RootDispersion = 0x0000008 // ~122us
+	r := generateResponse(h, dst, nil)
+	next := r.NextPoll(time.Millisecond)
+	expected := time.Duration((time.Millisecond - r.RootDistance).Seconds() / 15e-6 * 1e9)
+	assert.InDelta(t, float64(expected), float64(next.Sub(dst.Time())), float64(time.Microsecond))
+}
+
+func TestOfflineClassifyError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class QueryErrorClass
+	}{
+		{nil, ClassUnknown},
+		{errors.New("something else"), ClassUnknown},
+		{timeoutError{}, ClassTimeout},
+		{&net.OpError{Op: "read", Net: "udp", Err: timeoutError{}}, ClassTimeout},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", errConnRefused)}, ClassRefused},
+		{&net.DNSError{Err: "no such host", Name: "bogus.invalid", IsNotFound: true}, ClassDNSFailure},
+		{&net.DNSError{Err: "timeout", Name: "bogus.invalid", IsTimeout: true}, ClassDNSFailure},
+		{ErrAuthFailed, ClassAuthFailure},
+		{ErrInvalidAuthKey, ClassAuthFailure},
+		{ErrKissOfDeath, ClassKissOfDeath},
+		{ErrInvalidMode, ClassInvalidResponse},
+		{ErrServerResponseMismatch, ClassInvalidResponse},
+		{ErrServerClockFreshness, ClassInvalidResponse},
+		{fmt.Errorf("wrapped: %w", ErrInvalidStratum), ClassInvalidResponse},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.class, ClassifyError(c.err), "%v", c.err)
+	}
+
+	assert.Equal(t, "kiss of death", ClassKissOfDeath.String())
+	assert.Equal(t, "unknown", QueryErrorClass(100).String())
+}
+
+func TestOfflineQueryHappyEyeballs(t *testing.T) {
+	res := &fakeResolver{
+		ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+	}
+
+	// Each address family is dialed using its own callback. Servers reply
+	// with the given stratum.
+	var mu sync.Mutex
+	var dialed []string
+	dialer := func(v6, v4 func(la, ra string) (net.Conn, error)) func(la, ra string) (net.Conn, error) {
+		return func(la, ra string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, ra)
+			mu.Unlock()
+			if strings.HasPrefix(ra, "[") {
+				return v6(la, ra)
+			}
+			return v4(la, ra)
+		}
+	}
+	reply := func(stratum uint8) func(la, ra string) (net.Conn, error) {
+		return fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, func(h *header) { h.Stratum = stratum }), addr}}
+		})
+	}
+	fail := func(la, ra string) (net.Conn, error) {
+		return nil, errors.New("network unreachable")
+	}
+
+	// IPv6 fails fast, so IPv4 must be attempted without waiting for the
+	// fallback delay, which never expires.
+	const never = time.Hour
+	opt := QueryOptions{Dialer: dialer(fail, reply(4)), Resolver: res}
+	r, err := queryHappyEyeballs("dualstack.example", opt, never)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(4), r.Stratum)
+	assert.Equal(t, []string{"[2001:db8::1]:123", "192.0.2.1:123"}, dialed)
+
+	// IPv6 works, so it wins and IPv4 is never attempted.
+	dialed = nil
+	opt.Dialer = dialer(reply(6), reply(4))
+	r, err = queryHappyEyeballs("dualstack.example:1234", opt, never)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(6), r.Stratum)
+	assert.Equal(t, []string{"[2001:db8::1]:1234"}, dialed)
+
+	// IPv6 doesn't complete before the fallback delay, so IPv4 is started
+	// and wins. The IPv6 attempt is then cancelled. Both attempts are
+	// dialed by the context-aware dialer with the local address.
+	var locals []string
+	cancelled := make(chan error, 1)
+	opt = QueryOptions{
+		LocalAddress: "local",
+		Resolver:     res,
+		DialerContext: func(ctx context.Context, la, ra string) (net.Conn, error) {
+			mu.Lock()
+			locals = append(locals, la)
+			mu.Unlock()
+			if strings.HasPrefix(ra, "[") {
+				<-ctx.Done()
+				cancelled <- ctx.Err()
+				return nil, ctx.Err()
+			}
+			return reply(4)(la, ra)
+		},
+	}
+	r, err = queryHappyEyeballs("dualstack.example", opt, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(4), r.Stratum)
+	assert.Equal(t, context.Canceled, <-cancelled)
+	assert.Equal(t, []string{"local", "local"}, locals)
+
+	// Both fail, so the IPv6 error is reported.
+	dialed = nil
+	opt = QueryOptions{Dialer: dialer(fail, fail), Resolver: res}
+	r, err = queryHappyEyeballs("dualstack.example", opt, never)
+	assert.Nil(t, r)
+	assert.EqualError(t, err, "network unreachable")
+	assert.Equal(t, []string{"[2001:db8::1]:123", "192.0.2.1:123"}, dialed)
+	assert.Equal(t, []string{"dualstack.example"}, res.hosts[:1])
+}
+
+func TestOfflineOneWayDelays(t *testing.T) {
+	start := time.Now()
+	h := &header{
+		Stratum:       1,
+		ReferenceID:   refID,
+		ReferenceTime: toNtpTime(start),
+		OriginTime:    toNtpTime(start),
+		ReceiveTime:   toNtpTime(start.Add(30 * time.Millisecond)),
+		TransmitTime:  toNtpTime(start.Add(31 * time.Millisecond)),
+	}
+	r := generateResponse(h, toNtpTime(start.Add(61*time.Millisecond)), nil)
+	assert.Equal(t, 60*time.Millisecond, r.RTT)
+	assert.Equal(t, r.RTT/2, r.OutboundDelay)
+	assert.Equal(t, r.RTT/2, r.InboundDelay)
+	assert.Equal(t, r.RTT, r.OutboundDelay+r.InboundDelay)
+}
+
+func TestOfflineResolver(t *testing.T) {
+	addr := startServer(t, func(q []byte) [][]byte {
+		return [][]byte{makeReply(q, func(h *header) { h.Stratum = 2 })}
+	})
+
+	res := &fakeResolver{ips: []net.IP{addr.IP}}
+	opt := QueryOptions{Resolver: res, Timeout: time.Second}
+	r, err := QueryWithOptions(fmt.Sprintf("ntp.example.invalid:%d", addr.Port), opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, uint8(2), r.Stratum)
+	assert.Equal(t, []string{"ntp.example.invalid"}, res.hosts)
+
+	// IP address literals don't require a lookup.
+	res.hosts = nil
+	r, err = QueryWithOptions(addr.String(), opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Nil(t, res.hosts)
+}
+
+func TestOfflineValidateAllowNotInSync(t *testing.T) {
+	r := SyntheticResponse(0)
+	r.Leap = LeapNotInSync
+	assert.Equal(t, ErrInvalidLeapSecond, r.Validate())
+	assert.Nil(t, r.ValidateWithOptions(ValidateOptions{AllowNotInSync: true}))
+
+	// Other problems are still detected under the relaxed option.
+	r.Stratum = 0
+	assert.Equal(t, ErrKissOfDeath, r.ValidateWithOptions(ValidateOptions{AllowNotInSync: true}))
+	r.Stratum = 2
+	r.RootDispersion = 20 * time.Second
+	assert.Equal(t, ErrInvalidDispersion, r.ValidateWithOptions(ValidateOptions{AllowNotInSync: true}))
+}
+
+func TestOfflineValidateAcceptedLeaps(t *testing.T) {
+	cases := []struct {
+		accepted []LeapIndicator
+		leap     LeapIndicator
+		valid    bool
+	}{
+		{nil, LeapNoWarning, true},
+		{nil, LeapAddSecond, true},
+		{nil, LeapDelSecond, true},
+		{nil, LeapNotInSync, false},
+		{[]LeapIndicator{}, LeapNoWarning, false},
+		{[]LeapIndicator{LeapNoWarning}, LeapNoWarning, true},
+		{[]LeapIndicator{LeapNoWarning}, LeapAddSecond, false},
+		{[]LeapIndicator{LeapNoWarning, LeapNotInSync}, LeapNotInSync, true},
+		{[]LeapIndicator{LeapAddSecond, LeapDelSecond}, LeapNoWarning, false},
+	}
+	for _, c := range cases {
+		r := SyntheticResponse(0)
+		r.Leap = c.leap
+		err := r.ValidateWithOptions(ValidateOptions{AcceptedLeaps: c.accepted})
+		if c.valid {
+			assert.Nil(t, err, "%v %d", c.accepted, c.leap)
+		} else {
+			assert.Equal(t, ErrInvalidLeapSecond, err, "%v %d", c.accepted, c.leap)
+		}
+	}
+
+	// AllowNotInSync adds LeapNotInSync to an explicit set.
+	r := SyntheticResponse(0)
+	r.Leap = LeapNotInSync
+	opt := ValidateOptions{AcceptedLeaps: []LeapIndicator{LeapNoWarning}, AllowNotInSync: true}
+	assert.Nil(t, r.ValidateWithOptions(opt))
+}
+
+func TestOfflineOffsetRounding(t *testing.T) {
+	// When the sum of the two deltas is odd, their mean lies halfway
+	// between two timestamp units and is rounded to even. A mean of 2.5
+	// units (~0.58ns) rounds to 2 units (~0.47ns), or 0ns, no matter which
+	// of the two deltas is larger.
+	cases := []struct {
+		org, rec, xmt, dst ntpTime
+		expected           time.Duration
+	}{
+		{0, 5, 5, 5, 0},  // a=5, b=0
+		{0, 0, 5, 0, 0},  // a=0, b=5
+		{5, 0, 0, 0, 0},  // a=-5, b=0
+		{0, 0, 0, 5, 0},  // a=0, b=-5
+		{0, 7, 7, 7, 1},  // a=7, b=0: mean 3.5 rounds to 4 (~0.93ns)
+		{0, 0, 0, 7, -1}, // a=0, b=-7
+		{0, 9, 9, 8, 1},  // a=9, b=1: mean 5 (~1.16ns), no rounding
+		{8, 1, 1, 0, -1}, // a=-7, b=1: mean -3 (~-0.70ns)
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, offset(c.org, c.rec, c.xmt, c.dst))
+	}
+}
+
+func TestOfflineOptionUnsupported(t *testing.T) {
+	// The fake connection has no underlying socket, so the TTL socket option
+	// can't be applied to it.
+	opt := QueryOptions{
+		TTL: 5,
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.True(t, errors.Is(err, ErrOptionUnsupported))
+	assert.Contains(t, err.Error(), "TTL")
+
+	// Likewise for the don't-route option.
+	opt.TTL = 0
+	opt.DontRoute = true
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.True(t, errors.Is(err, ErrOptionUnsupported))
+	assert.Contains(t, err.Error(), "DontRoute")
+}
+
+func TestOfflineMeasurement(t *testing.T) {
+	r := SyntheticResponse(250 * time.Millisecond)
+	r.MinError = 5 * time.Millisecond
+	m := r.Measurement()
+	assert.Equal(t, r.ClockOffset, m.Offset)
+	assert.Equal(t, r.RootDistance+r.MinError, m.Uncertainty)
+	assert.Equal(t, r.dst.Time().Add(r.ClockOffset), m.Time)
+	assert.InDelta(t, 1-m.Uncertainty.Seconds(), m.Quality, 1e-9)
+
+	// Imprecise and invalid responses are given no weight.
+	r.RootDispersion = 2 * time.Second
+	r.RootDistance = rootDistance(r.RTT, r.RootDelay, r.RootDispersion)
+	assert.Equal(t, 0.0, r.Measurement().Quality)
+
+	r = SyntheticResponse(0)
+	r.Stratum = 0
+	assert.Equal(t, 0.0, r.Measurement().Quality)
+}
+
+func TestOfflineValidateMaxStratum(t *testing.T) {
+	r := SyntheticResponse(0)
+	r.Stratum = 15
+	assert.Nil(t, r.Validate())
+	r.Stratum = 16
+	assert.Equal(t, ErrInvalidStratum, r.Validate())
+	assert.Nil(t, r.ValidateWithOptions(ValidateOptions{MaxStratum: 17}))
+	r.Stratum = 255
+	assert.Equal(t, ErrInvalidStratum, r.ValidateWithOptions(ValidateOptions{MaxStratum: 255}))
+	assert.Nil(t, r.ValidateWithOptions(ValidateOptions{MaxStratum: 256}))
+
+	// A lower ceiling may also be used.
+	r.Stratum = 4
+	assert.Equal(t, ErrInvalidStratum, r.ValidateWithOptions(ValidateOptions{MaxStratum: 4}))
+
+	// Kiss of death responses are rejected regardless of the ceiling.
+	r.Stratum = 0
+	assert.Equal(t, ErrKissOfDeath, r.ValidateWithOptions(ValidateOptions{MaxStratum: 256}))
+}
+
+func TestOfflineRootDelaySane(t *testing.T) {
+	const ms = time.Millisecond
+	cases := []struct {
+		Stratum   uint8
+		RootDelay time.Duration
+		RTT       time.Duration
+		Sane      bool
+	}{
+		{0, 0, 0, true},
+		{0, 10 * time.Second, 0, true},
+		{1, 0, 0, true},
+		{1, 100 * time.Microsecond, 0, true},
+		{2, 0, 0, false},
+		{2, 15 * ms, 0, true},
+		{3, 900 * ms, 0, true},
+		{3, 5 * time.Second, 0, false},
+		{1, 2 * time.Second, 0, false},
+
+		// Root delays implausibly small for the stratum.
+		{2, 10 * time.Microsecond, 20 * ms, true},
+		{2, 5 * time.Microsecond, 20 * ms, false},
+		{5, 30 * time.Microsecond, 20 * ms, false},
+		{5, 40 * time.Microsecond, 20 * ms, true},
+
+		// Root delays relative to the RTT.
+		{2, 30 * ms, 20 * ms, true},
+		{2, 30 * ms, 200 * time.Microsecond, true},
+		{2, 300 * ms, 20 * ms, true},
+		{2, 301 * ms, 20 * ms, false},
+		{3, 900 * ms, 20 * ms, false},
+		{3, 900 * ms, 80 * ms, true},
+		{1, 150 * ms, 1 * ms, false},
+		{1, 150 * ms, 0, true},
+	}
+	for _, c := range cases {
+		r := Response{Stratum: c.Stratum, RootDelay: c.RootDelay, RTT: c.RTT}
+		assert.Equal(t, c.Sane, r.RootDelaySane(), "stratum %d, root delay %v, rtt %v", c.Stratum, c.RootDelay, c.RTT)
+	}
+}
+
+func TestOfflineOnComplete(t *testing.T) {
+	var events []Event
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+		OnComplete: func(e Event) { events = append(events, e) },
+	}
+
+	// Successful query.
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	e := events[0]
+	assert.Equal(t, "remote", e.Address)
+	assert.Equal(t, 48, len(e.Request))
+	assert.Equal(t, 48, len(e.Reply))
+	assert.Equal(t, e.Request[40:48], e.Reply[24:32])
+	assert.False(t, e.SendTime.IsZero())
+	assert.False(t, e.ReceiveTime.Before(e.SendTime))
+	assert.Equal(t, r, e.Response)
+	assert.Nil(t, e.Err)
+
+	// Server sends an invalid reply.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, func(h *header) { h.setMode(ModeClient) }), addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrInvalidMode, err)
+	assert.Equal(t, 2, len(events))
+	e = events[1]
+	assert.Equal(t, 48, len(e.Request))
+	assert.Equal(t, 48, len(e.Reply))
+	assert.Nil(t, e.Response)
+	assert.Equal(t, ErrInvalidMode, e.Err)
+
+	// Server doesn't respond.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram { return nil })
+	_, err = QueryWithOptions("remote", opt)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, len(events))
+	e = events[2]
+	assert.Equal(t, 48, len(e.Request))
+	assert.Nil(t, e.Reply)
+	assert.Nil(t, e.Response)
+	assert.Equal(t, err, e.Err)
+
+	// Connection can't be established.
+	dialErr := errors.New("not dialing")
+	opt.Dialer = func(la, ra string) (net.Conn, error) { return nil, dialErr }
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, dialErr, err)
+	assert.Equal(t, 4, len(events))
+	e = events[3]
+	assert.Nil(t, e.Request)
+	assert.Equal(t, dialErr, e.Err)
+}
+
+func TestOfflineResponseMode(t *testing.T) {
+	cases := []struct {
+		LiVnMode uint8
+		Mode     Mode
+	}{
+		{0x24, ModeServer},           // leap 0, version 4, mode 4
+		{0xe4, ModeServer},           // leap 3, version 4, mode 4
+		{0x1a, ModeSymmetricPassive}, // leap 0, version 3, mode 2
+		{0x25, ModeBroadcast},        // leap 0, version 4, mode 5
+		{0x23, ModeClient},           // leap 0, version 4, mode 3
+		{0x27, ModeReservedPrivate},  // leap 0, version 4, mode 7
+	}
+	for _, c := range cases {
+		h := &header{LiVnMode: c.LiVnMode, Stratum: 1}
+		r := generateResponse(h, 0, nil)
+		assert.Equal(t, c.Mode, r.Mode)
+	}
+}
+
+func TestOfflineTrailingBytes(t *testing.T) {
+	extra := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01, 0x02, 0x03}
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{append(makeReply(q, nil), extra...), addr}}
+		}),
+	}
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Validate())
+	assert.Equal(t, extra, r.TrailingBytes)
+	assert.Equal(t, "192.0.2.1:123", r.RemoteAddr.String())
+
+	// A header-only reply has no trailing bytes.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.TrailingBytes)
+
+	// A verified MAC is excluded from the trailing bytes.
+	opt.Auth = AuthOptions{AuthMD5, "45a5f7c1bd5e8e2d", 1}
+	key, _ := decodeAuthKey(opt.Auth)
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		reply := bytes.NewBuffer(append(makeReply(q, nil), extra...))
+		appendMAC(reply, opt.Auth, key)
+		return []datagram{{reply.Bytes(), addr}}
+	})
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Validate())
+	assert.Equal(t, extra, r.TrailingBytes)
+}
+
+func TestOfflineToMap(t *testing.T) {
+	r := SyntheticResponse(1500 * time.Microsecond)
+	r.Leap = LeapAddSecond
+	r.RemoteAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	r.OffsetFloat = 0.0015
+	r.RawRequest = []byte{0x23, 0x00}
+	r.RawResponse = []byte{0x24, 0x02}
+
+	m := r.ToMap()
+	assert.Equal(t, map[string]interface{}{
+		"Time":            r.Time.Format(time.RFC3339Nano),
+		"ClockOffset":     "1.5ms",
+		"OffsetFloat":     0.0015,
+		"RTT":             r.RTT.String(),
+		"OutboundDelay":   r.OutboundDelay.String(),
+		"InboundDelay":    r.InboundDelay.String(),
+		"Precision":       r.Precision.String(),
+		"PrecisionExp":    -20,
+		"Version":         4,
+		"Mode":            "server",
+		"Stratum":         2,
+		"ReferenceID":     "192.0.2.1",
+		"ReferenceTime":   r.ReferenceTime.Format(time.RFC3339Nano),
+		"RootDelay":       r.RootDelay.String(),
+		"RootDispersion":  r.RootDispersion.String(),
+		"RootDistance":    r.RootDistance.String(),
+		"Leap":            "add second",
+		"MinError":        "0s",
+		"KissCode":        "",
+		"UnknownKiss":     false,
+		"Poll":            "1m4s",
+		"RemoteAddr":      "192.0.2.1:123",
+		"TrailingBytes":   "",
+		"ExtensionFields": []map[string]interface{}{},
+		"RawRequest":      "2300",
+		"RawResponse":     "2402",
+		"SendInstant":     r.SendInstant.Format(time.RFC3339Nano),
+		"RecvInstant":     r.RecvInstant.Format(time.RFC3339Nano),
+	}, m)
+
+	// Every exported field is reported.
+	typ := reflect.TypeOf(*r)
+	for i := 0; i < typ.NumField(); i++ {
+		if f := typ.Field(i); f.PkgPath == "" {
+			assert.Contains(t, m, f.Name)
+		}
+	}
+
+	// Kiss codes are reported as the reference ID.
+	r = SyntheticResponse(0)
+	r.Stratum = 0
+	r.ReferenceID = 0x52415445
+	r.KissCode = "RATE"
+	m = r.ToMap()
+	assert.Equal(t, "RATE", m["ReferenceID"])
+	assert.Equal(t, "RATE", m["KissCode"])
+	assert.Equal(t, false, m["UnknownKiss"])
+	assert.Equal(t, "", m["RemoteAddr"])
+	assert.Equal(t, "", m["TrailingBytes"])
+	assert.Equal(t, []map[string]interface{}{}, m["ExtensionFields"])
+}
+
+func TestOfflineFromMap(t *testing.T) {
+	r := SyntheticResponse(1500 * time.Microsecond)
+	r.Leap = LeapAddSecond
+	r.RemoteAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	r.TrailingBytes = make([]byte, 28)
+	binary.BigEndian.PutUint32(r.TrailingBytes, 0x0104001c)
+	r.TrailingBytes[27] = 0xab
+	r.ExtensionFields = parseExtensionFields(r.TrailingBytes)
+	r.OffsetFloat = 0.0015
+	r.RawRequest = []byte{0x23, 0x00}
+	r.RawResponse = []byte{0x24, 0x02}
+
+	m := r.ToMap()
+	assert.Equal(t, "0104001c"+strings.Repeat("00", 23)+"ab", m["TrailingBytes"])
+	assert.Equal(t, []map[string]interface{}{
+		{"Type": 0x0104, "Data": strings.Repeat("00", 23) + "ab"},
+	}, m["ExtensionFields"])
+
+	var r2 Response
+	assert.Nil(t, r2.FromMap(m))
+	assert.Equal(t, m, r2.ToMap())
+	assert.True(t, r.Time.Equal(r2.Time))
+	assert.True(t, r.ReferenceTime.Equal(r2.ReferenceTime))
+	assert.Equal(t, r.ClockOffset, r2.ClockOffset)
+	assert.Equal(t, r.RTT, r2.RTT)
+	assert.Equal(t, r.Precision, r2.Precision)
+	assert.Equal(t, ModeServer, r2.Mode)
+	assert.Equal(t, LeapIndicator(LeapAddSecond), r2.Leap)
+	assert.Equal(t, r.ReferenceID, r2.ReferenceID)
+	assert.Equal(t, r.RootDistance, r2.RootDistance)
+	assert.Equal(t, r.Poll, r2.Poll)
+	assert.Equal(t, r.RemoteAddr, r2.RemoteAddr)
+	assert.Equal(t, r.TrailingBytes, r2.TrailingBytes)
+	assert.Equal(t, r.ExtensionFields, r2.ExtensionFields)
+	assert.Equal(t, r.OffsetFloat, r2.OffsetFloat)
+	assert.Equal(t, r.PrecisionExp, r2.PrecisionExp)
+	assert.Equal(t, r.RawRequest, r2.RawRequest)
+	assert.Equal(t, r.RawResponse, r2.RawResponse)
+	assert.True(t, r.SendInstant.Equal(r2.SendInstant))
+	assert.True(t, r.RecvInstant.Equal(r2.RecvInstant))
+
+	// The map survives encoding as JSON.
+	b, err := json.Marshal(m)
+	assert.Nil(t, err)
+	var jm map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &jm))
+	var r3 Response
+	assert.Nil(t, r3.FromMap(jm))
+	assert.Equal(t, m, r3.ToMap())
+
+	// Kiss codes and stratum 1 reference IDs are recovered.
+	kod := SyntheticResponse(0)
+	kod.Stratum = 0
+	kod.ReferenceID = 0x58595a57
+	kod.KissCode = "XYZW"
+	kod.UnknownKiss = true
+	assert.Nil(t, r2.FromMap(kod.ToMap()))
+	assert.Equal(t, uint32(0x58595a57), r2.ReferenceID)
+	assert.Equal(t, "XYZW", r2.KissCode)
+	assert.True(t, r2.UnknownKiss)
+	assert.Nil(t, r2.RemoteAddr)
+	assert.Nil(t, r2.TrailingBytes)
+
+	gps := SyntheticResponse(0)
+	gps.Stratum = 1
+	gps.ReferenceID = 0x47505300
+	assert.Nil(t, r2.FromMap(gps.ToMap()))
+	assert.Equal(t, uint32(0x47505300), r2.ReferenceID)
+
+	// Missing and malformed values are reported, and the response is
+	// cleared.
+	m2 := r.ToMap()
+	delete(m2, "RTT")
+	assert.Equal(t, "missing RTT in response map", r2.FromMap(m2).Error())
+	assert.Equal(t, Response{}, r2)
+
+	for _, key := range []string{"Time", "Stratum", "Mode", "Leap", "ReferenceID", "RemoteAddr", "TrailingBytes", "RawRequest", "OffsetFloat", "SendInstant"} {
+		m2 = r.ToMap()
+		m2[key] = "bogus"
+		assert.Equal(t, fmt.Sprintf("invalid %s in response map", key), r2.FromMap(m2).Error())
+	}
+}
+
+func TestOfflineRawPackets(t *testing.T) {
+	auth := AuthOptions{AuthSHA1, "HEX:6931564b4a5a5045766c55356b30656c7666316c", 2}
+	key, _ := decodeAuthKey(auth)
+
+	// The query carries a client ID field, and the authenticated reply
+	// carries an extension field. Both are followed by a MAC.
+	var request, reply []byte
+	opt := QueryOptions{
+		Auth:     auth,
+		ClientID: "client",
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			request = q
+			buf := bytes.NewBuffer(makeReply(q, nil))
+			appendExtensionField(buf, 0x0104, []byte("field"))
+			appendMAC(buf, auth, key)
+			reply = buf.Bytes()
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	r, err := QueryWithOptions("remote", opt)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, request, r.RawRequest)
+	assert.Equal(t, reply, r.RawResponse)
+	assert.Equal(t, 48+28+24, len(r.RawResponse))
+	assert.Equal(t, len(r.RawResponse), cap(r.RawResponse))
+}
+
+func TestOfflineExtensionFields(t *testing.T) {
+	field := func(typ uint16, length int) []byte {
+		b := make([]byte, length)
+		binary.BigEndian.PutUint16(b[0:], typ)
+		binary.BigEndian.PutUint16(b[2:], uint16(length))
+		for i := 4; i < length; i++ {
+			b[i] = byte(i)
+		}
+		return b
+	}
+	mac := make([]byte, 20)
+	mac[3] = 1 // key ID 1
+
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	cases := []struct {
+		trailing []byte
+		types    []uint16
+	}{
+		// A minimum-length field followed by a field padded to the
+		// 28-byte minimum required of a last field.
+		{join(field(0x0104, 16), field(0x0204, 28)), []uint16{0x0104, 0x0204}},
+
+		// Short fields are permitted when followed by a legacy MAC, which
+		// is not a field.
+		{join(field(0x0104, 16), mac), []uint16{0x0104}},
+		{mac, nil},
+		{make([]byte, 24), nil},
+
+		// Parsing stops at malformed fields.
+		{join(field(0x0104, 28), field(0x0204, 30)[:28]), []uint16{0x0104}},
+		{join(field(0x0104, 16), field(0x0204, 12), make([]byte, 16)), []uint16{0x0104}},
+		{field(0x0104, 32)[:28], nil},
+		{nil, nil},
+	}
+
+	for i, c := range cases {
+		trailing := c.trailing
+		opt := QueryOptions{
+			Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+				return []datagram{{append(makeReply(q, nil), trailing...), addr}}
+			}),
+		}
+		r, err := QueryWithOptions("remote", opt)
+		if !assert.Nil(t, err, i) {
+			continue
+		}
+
+		var types []uint16
+		for _, f := range r.ExtensionFields {
+			types = append(types, f.Type)
+		}
+		assert.Equal(t, c.types, types, i)
+	}
+
+	// Field data excludes the field header but includes padding.
+	fields := parseExtensionFields(field(0x0104, 28))
+	if assert.Equal(t, 1, len(fields)) {
+		assert.Equal(t, field(0x0104, 28)[4:], fields[0].Data)
+	}
+}
+
+func TestOfflineFormatTimes(t *testing.T) {
+	base := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := header{
+		Stratum:       1,
+		ReferenceTime: toNtpTime(base),
+		OriginTime:    toNtpTime(base.Add(1 * time.Second)),
+		ReceiveTime:   toNtpTime(base.Add(2 * time.Second)),
+		TransmitTime:  toNtpTime(base.Add(3 * time.Second)),
+	}
+	h.setMode(ModeServer)
+	r := generateResponse(&h, toNtpTime(base.Add(4*time.Second)), nil)
+
+	loc := time.FixedZone("UTC+9", 9*60*60)
+	times := r.FormatTimes("15:04:05 MST", loc)
+	assert.Equal(t, map[string]string{
+		"ReferenceTime":   "21:00:00 UTC+9",
+		"OriginTime":      "21:00:01 UTC+9",
+		"ReceiveTime":     "21:00:02 UTC+9",
+		"TransmitTime":    "21:00:03 UTC+9",
+		"DestinationTime": "21:00:04 UTC+9",
+	}, times)
+}
+
+func TestOfflineDetailedErrors(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.setMode(ModeSymmetricPassive)
+				h.Stratum = 3
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	// By default, the sentinel error is returned as is.
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrInvalidMode, err)
+
+	// With detailed errors, the rejected response accompanies the error.
+	opt.DetailedErrors = true
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.True(t, errors.Is(err, ErrInvalidMode))
+	assert.Equal(t, ErrInvalidMode.Error(), err.Error())
+	assert.Equal(t, ClassInvalidResponse, ClassifyError(err))
+	var qerr *QueryError
+	assert.True(t, errors.As(err, &qerr))
+	assert.Equal(t, ModeSymmetricPassive, qerr.Response.Mode)
+	assert.Equal(t, uint8(3), qerr.Response.Stratum)
+
+	// Errors that occur before a response is received aren't wrapped.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram { return nil })
+	_, err = QueryWithOptions("remote", opt)
+	assert.False(t, errors.As(err, &qerr))
+}
+
+func TestOfflineQueryErrorRawResponse(t *testing.T) {
+	// A datagram too short to contain a header can't be parsed.
+	var sent []byte
+	opt := QueryOptions{
+		DetailedErrors: true,
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			sent = makeReply(q, nil)[:20]
+			return []datagram{{sent, addr}}
+		}),
+	}
+	_, err := QueryWithOptions("remote", opt)
+	var qerr *QueryError
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Nil(t, qerr.Response)
+		assert.Equal(t, sent, qerr.RawResponse)
+	}
+
+	// A rejected response is accompanied by its raw bytes.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		sent = makeReply(q, func(h *header) { h.TransmitTime = 0 })
+		return []datagram{{sent, addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Equal(t, ErrInvalidTransmitTime, qerr.Err)
+		assert.NotNil(t, qerr.Response)
+		assert.Equal(t, sent, qerr.RawResponse)
+	}
+
+	// The raw bytes of an oversized response are truncated.
+	opt.MaxResponseSize = 60
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		sent = append(makeReply(q, nil), make([]byte, 52)...)
+		return []datagram{{sent, addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Equal(t, ErrResponseTooLarge, qerr.Err)
+		assert.Equal(t, 60, len(qerr.RawResponse))
+		assert.Equal(t, sent[:60], qerr.RawResponse)
+	}
+}
+
+func TestOfflineClockTickTolerance(t *testing.T) {
+	// The server's receive time exceeds its transmit time by 500us.
+	const over = 500 * time.Microsecond
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.ReceiveTime = toNtpTime(h.TransmitTime.Time().Add(over))
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	// The error reports the overage.
+	_, err := QueryWithOptions("remote", opt)
+	assert.True(t, errors.Is(err, ErrServerTickedBackwards))
+	assert.EqualError(t, err, "server clock ticked backwards by 500µs")
+	assert.Equal(t, ClassInvalidResponse, ClassifyError(err))
+
+	opt.ClockTickTolerance = 100 * time.Microsecond
+	_, err = QueryWithOptions("remote", opt)
+	assert.True(t, errors.Is(err, ErrServerTickedBackwards))
+	assert.EqualError(t, err, "server clock ticked backwards by 500µs")
+
+	opt.ClockTickTolerance = time.Millisecond
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+
+	// Detailed errors also report the overage.
+	opt.ClockTickTolerance = 0
+	opt.DetailedErrors = true
+	_, err = QueryWithOptions("remote", opt)
+	assert.True(t, errors.Is(err, ErrServerTickedBackwards))
+	assert.EqualError(t, err, "server clock ticked backwards by 500µs")
+
+	// Timestamps on either side of an era rollover are in order.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		reply := makeReply(q, func(h *header) {
+			h.ReceiveTime = 0xffffffff00000000
+			h.TransmitTime = 0x0000000000001000
+		})
+		return []datagram{{reply, addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+}
+
+func TestOfflineTimeStrict(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	tm, err := TimeStrict("remote", opt)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), tm, time.Second)
+
+	// Invalid responses produce the zero time.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		reply := makeReply(q, func(h *header) { h.Stratum = 0 })
+		return []datagram{{reply, addr}}
+	})
+	tm, err = TimeStrict("remote", opt)
+	assert.Equal(t, ErrKissOfDeath, err)
+	assert.True(t, tm.IsZero())
+
+	// So do failed queries.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram { return nil })
+	tm, err = TimeStrict("remote", opt)
+	assert.NotNil(t, err)
+	assert.True(t, tm.IsZero())
+}
+
+func TestOfflinePrecisionString(t *testing.T) {
+	cases := []struct {
+		exp int8
+		str string
+	}{
+		{-29, "-29 (~1.9ns)"},
+		{-20, "-20 (~954ns)"},
+		{-10, "-10 (~977µs)"},
+		{-6, "-6 (~16ms)"},
+		{-1, "-1 (~500ms)"},
+		{0, "0 (~1.0s)"},
+		{3, "3 (~8.0s)"},
+		{-40, "-40 (~909fs)"},
+		{-50, "-50 (~888as)"},
+		{-128, "-128 (~2.9e-39s)"},
+	}
+	for _, c := range cases {
+		h := header{Precision: c.exp}
+		r := generateResponse(&h, 0, nil)
+		assert.Equal(t, c.exp, r.PrecisionExp)
+		assert.Equal(t, c.str, r.PrecisionString())
+	}
+}
+
+func TestOfflineMaxResponseSize(t *testing.T) {
+	size := 0
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := append(makeReply(q, nil), make([]byte, size-48)...)
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	// The default limit is 1024 bytes.
+	size = 1024
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 1024-48, len(r.TrailingBytes))
+
+	size = 1025
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Equal(t, ClassInvalidResponse, ClassifyError(err))
+
+	size = 9000
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrResponseTooLarge, err)
+
+	// The limit is configurable.
+	opt.MaxResponseSize = 48
+	size = 48
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	size = 56
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrResponseTooLarge, err)
+}
+
+func TestOfflineRFCStats(t *testing.T) {
+	// Use timestamps with fractions that are exact in both the NTP and
+	// time.Duration representations.
+	const t64 = ntpTime(1<<32) / 64 // 1/64 second
+	h := header{
+		Stratum:       1,
+		Precision:     -10, // 976562ns
+		ReferenceTime: 100 << 32,
+		OriginTime:    100 << 32,
+		ReceiveTime:   100<<32 + 2*t64,
+		TransmitTime:  100<<32 + 3*t64,
+	}
+	h.setMode(ModeServer)
+	r := generateResponse(&h, 100<<32+4*t64, nil)
+
+	offset, delay, disp := r.RFCStats()
+
+	// theta = ((rec-org) + (xmt-dst)) / 2 = (2/64 - 1/64) / 2
+	assert.Equal(t, 7812500*time.Nanosecond, offset)
+
+	// delta = (dst-org) - (xmt-rec) = 4/64 - 1/64
+	assert.Equal(t, 46875000*time.Nanosecond, delay)
+
+	// epsilon = 976562ns + 1ns + 15e-6 * 4/64s (937.5ns)
+	assert.Equal(t, 977500*time.Nanosecond, disp)
+
+	// The delay is never less than the local clock's precision.
+	h.TransmitTime = h.ReceiveTime + 4*t64
+	r = generateResponse(&h, 100<<32+4*t64, nil)
+	_, delay, _ = r.RFCStats()
+	assert.Equal(t, time.Nanosecond, delay)
+}
+
+func TestOfflineUsesLocalClockFallback(t *testing.T) {
+	cases := []struct {
+		Stratum  byte
+		RefID    uint32
+		Fallback bool
+	}{
+		{10, 0x4c4f434c, true},  // LOCL
+		{1, 0x4c4f434c, true},   // LOCL
+		{5, 0x4c434c00, true},   // LCL
+		{10, 0x7f7f0101, true},  // 127.127.1.1
+		{10, 0x7f7f0100, true},  // 127.127.1.0
+		{3, 0x7f7f1400, false},  // 127.127.20.0 (NMEA driver)
+		{1, 0x47505300, false},  // GPS
+		{2, 0xc0a80001, false},  // 192.168.0.1
+		{0, 0x4c4f434c, false},  // kiss of death
+		{10, 0x7f000001, false}, // 127.0.0.1
+	}
+	for _, c := range cases {
+		r := Response{Stratum: c.Stratum, ReferenceID: c.RefID}
+		assert.Equal(t, c.Fallback, r.UsesLocalClockFallback(), "%d %08x", c.Stratum, c.RefID)
+	}
+}
+
+func TestOfflineClientID(t *testing.T) {
+	var query []byte
+	opt := QueryOptions{
+		ClientID: "host-42.example",
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			query = q
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Validate())
+
+	// The identifier is padded to the minimum field length of 28 bytes.
+	assert.Equal(t, 48+28, len(query))
+	ext := query[48:]
+	assert.Equal(t, uint16(ClientIDFieldType), binary.BigEndian.Uint16(ext[0:]))
+	assert.Equal(t, uint16(28), binary.BigEndian.Uint16(ext[2:]))
+	assert.Equal(t, "host-42.example", string(bytes.TrimRight(ext[4:], "\x00")))
+
+	// Longer identifiers are padded to a multiple of 4 bytes.
+	opt.ClientID = strings.Repeat("x", 29)
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 48+36, len(query))
+	assert.Equal(t, uint16(36), binary.BigEndian.Uint16(query[50:]))
+
+	// The MAC follows the field and covers it.
+	opt.ClientID = "host-42.example"
+	opt.Auth = AuthOptions{AuthSHA1, "HEX:6931564b4a5a5045766c55356b30656c7666316c", 2}
+	key, _ := decodeAuthKey(opt.Auth)
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		query = q
+		reply := bytes.NewBuffer(makeReply(q, nil))
+		appendMAC(reply, opt.Auth, key)
+		return []datagram{{reply.Bytes(), addr}}
+	})
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Validate())
+	assert.Equal(t, 48+28+24, len(query))
+	assert.Nil(t, verifyMAC(query, opt.Auth, key))
+
+	// Without an identifier, the query is the bare header.
+	opt = QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			query = q
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 48, len(query))
+
+	// Overlong identifiers are rejected.
+	opt.ClientID = strings.Repeat("x", 256)
+	_, err = QueryWithOptions("remote", opt)
+	assert.NotNil(t, err)
+}
+
+func TestOfflineCorrection(t *testing.T) {
+	r := SyntheticResponse(2 * time.Second)
+	c := r.Correction()
+	assert.Equal(t, 2*time.Second, c.Offset)
+	assert.WithinDuration(t, time.Now(), c.Time, 100*time.Millisecond)
+
+	// The corrected time advances with the local clock.
+	now1, corrected1 := time.Now(), c.Now()
+	assert.WithinDuration(t, now1.Add(2*time.Second), corrected1, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	now2, corrected2 := time.Now(), c.Now()
+	assert.WithinDuration(t, now2.Add(2*time.Second), corrected2, time.Millisecond)
+	assert.True(t, corrected2.Sub(corrected1) >= 20*time.Millisecond)
+
+	// Corrections from queries are anchored to the receive time.
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.ReceiveTime = toNtpTime(time.Now().Add(-time.Hour))
+				h.TransmitTime = h.ReceiveTime
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+	before := time.Now()
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	c = r.Correction()
+	assert.False(t, c.Time.Before(before))
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), c.Now(), 10*time.Millisecond)
+}
+
+func TestOfflineValidateTimestampOrder(t *testing.T) {
+	base := time.Now()
+	exchange := func(rec, xmt, dst time.Duration) *Response {
+		h := header{
+			Stratum:       1,
+			ReferenceTime: toNtpTime(base.Add(-time.Minute)),
+			OriginTime:    toNtpTime(base),
+			ReceiveTime:   toNtpTime(base.Add(rec)),
+			TransmitTime:  toNtpTime(base.Add(xmt)),
+		}
+		h.setMode(ModeServer)
+		return generateResponse(&h, toNtpTime(base.Add(dst)), nil)
+	}
+	opt := ValidateOptions{CheckTimestampOrder: true, TimestampOrderTolerance: 5 * time.Millisecond}
+
+	// A compliant exchange.
+	r := exchange(10*time.Millisecond, 11*time.Millisecond, 20*time.Millisecond)
+	assert.Nil(t, r.ValidateWithOptions(opt))
+
+	// A small offset is within the tolerance.
+	r = exchange(-2*time.Millisecond, -1*time.Millisecond, 20*time.Millisecond)
+	assert.Nil(t, r.ValidateWithOptions(opt))
+
+	// The server claims to have received the query before it was sent.
+	r = exchange(-time.Second, 11*time.Millisecond, 20*time.Millisecond)
+	assert.Equal(t, ErrInvalidTimestampOrder, r.ValidateWithOptions(opt))
+
+	// The server claims to have sent the response after it was received.
+	r = exchange(10*time.Millisecond, time.Second, 20*time.Millisecond)
+	assert.Equal(t, ErrInvalidTimestampOrder, r.ValidateWithOptions(opt))
+
+	// A large clock offset also breaks the ordering, so the check is off
+	// by default.
+	r = exchange(10*time.Second, 10*time.Second, 20*time.Millisecond)
+	assert.Equal(t, ErrInvalidTimestampOrder, r.ValidateWithOptions(opt))
+	assert.Nil(t, r.Validate())
+}
+
+func TestOfflinePreciseTime(t *testing.T) {
+	// The server's clock leads the local clock by 3 timestamp units
+	// (~0.70ns), which rounds to a ClockOffset of 1ns.
+	const org = ntpTime(100 << 32)
+	h := header{
+		Stratum:       1,
+		ReferenceTime: org,
+		OriginTime:    org,
+		ReceiveTime:   org + 1<<20 + 3,
+		TransmitTime:  org + 2<<20 + 3,
+	}
+	h.setMode(ModeServer)
+	r := generateResponse(&h, org+3<<20, nil)
+	assert.Equal(t, time.Nanosecond, r.ClockOffset)
+
+	now := time.Now()
+	p := r.preciseTime(now)
+	assert.Equal(t, 3.0/(1<<32), p.OffsetSeconds)
+	assert.Equal(t, (r.RootDistance + r.MinError).Seconds(), p.UncertaintySeconds)
+	assert.Equal(t, now.Add(time.Nanosecond), p.Wall)
+
+	// Negative sub-nanosecond offsets are retained too.
+	h.ReceiveTime -= 6
+	h.TransmitTime -= 6
+	r = generateResponse(&h, org+3<<20, nil)
+	assert.Equal(t, -3.0/(1<<32), r.preciseTime(now).OffsetSeconds)
+
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	p, err := PreciseTimeQuery("remote", opt)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), p.Wall, time.Second)
+	assert.True(t, p.UncertaintySeconds > 0)
+}
+
+func TestOfflineLeapWithin(t *testing.T) {
+	cases := []struct {
+		time   string
+		leap   LeapIndicator
+		within time.Duration
+		result bool
+	}{
+		{"2016-12-31 23:00:00", LeapAddSecond, 2 * time.Hour, true},
+		{"2016-12-31 23:59:59", LeapAddSecond, time.Second, true},
+		{"2016-12-31 20:00:00", LeapAddSecond, 2 * time.Hour, false},
+		{"2016-12-01 00:00:00", LeapAddSecond, 24 * time.Hour, false},
+		{"2015-06-30 12:00:00", LeapDelSecond, 24 * time.Hour, true},
+		{"2016-02-29 22:00:00", LeapAddSecond, 2 * time.Hour, true},
+		{"2016-12-31 23:00:00", LeapNoWarning, 2 * time.Hour, false},
+		{"2016-12-31 23:00:00", LeapNotInSync, 2 * time.Hour, false},
+	}
+
+	timeFormat := "2006-01-02 15:04:05"
+
+	for _, c := range cases {
+		tm, _ := time.Parse(timeFormat, c.time)
+		r := Response{Time: tm, Leap: c.leap}
+		assert.Equal(t, c.result, r.LeapWithin(c.within), c.time)
+	}
+
+	// The server's time is interpreted in UTC regardless of its location.
+	tm := time.Date(2017, 1, 1, 8, 0, 0, 0, time.FixedZone("UTC+9", 9*60*60))
+	r := Response{Time: tm, Leap: LeapAddSecond}
+	assert.True(t, r.LeapWithin(time.Hour))
+}
+
+func TestOfflineSkipInternalChecks(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.setMode(ModeSymmetricPassive)
+				h.OriginTime++
+				h.ReceiveTime = h.TransmitTime + 1<<32
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrInvalidMode, err)
+
+	// The malformed response is returned for inspection.
+	opt.SkipInternalChecks = true
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, ModeSymmetricPassive, r.Mode)
+	assert.Equal(t, -time.Second, r.ServerProcessingDelay())
+}
+
+func TestOfflineIsAccurateEnough(t *testing.T) {
+	r := SyntheticResponse(0)
+	r.RootDistance = 20 * time.Millisecond
+	r.MinError = 5 * time.Millisecond
+
+	assert.True(t, r.IsAccurateEnough(26*time.Millisecond))
+	assert.True(t, r.IsAccurateEnough(25*time.Millisecond))
+	assert.False(t, r.IsAccurateEnough(25*time.Millisecond-1))
+	assert.False(t, r.IsAccurateEnough(20*time.Millisecond))
+}
+
+func TestOfflineWarmup(t *testing.T) {
+	// Each exchange reports a distinct stratum.
+	exchanges := 0
+	var events []Event
+	opt := QueryOptions{
+		Warmup: true,
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			exchanges++
+			stratum := uint8(exchanges)
+			reply := makeReply(q, func(h *header) { h.Stratum = stratum })
+			return []datagram{{reply, addr}}
+		}),
+		OnComplete: func(e Event) { events = append(events, e) },
+	}
+
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, exchanges)
+	assert.Equal(t, uint8(2), r.Stratum)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, r, events[0].Response)
+
+	// A failed warm-up query is ignored.
+	exchanges = 0
+	drop := true
+	opt.OnComplete = nil
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		exchanges++
+		if drop {
+			drop = false
+			return nil
+		}
+		return []datagram{{makeReply(q, nil), addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, exchanges)
+
+	// Without the option, there's a single exchange.
+	exchanges = 0
+	opt.Warmup = false
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, exchanges)
+
+	// Queries over a packet connection are also warmed up. The reply to
+	// the throwaway query is delivered late and discarded.
+	peers := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123},
+	}
+	var late []datagram
+	conn := &fakePacketConn{
+		reply: func(q []byte, addr net.Addr) []datagram {
+			if late == nil {
+				late = []datagram{{makeReply(q, func(h *header) { h.Stratum = 5 }), addr}}
+				return nil
+			}
+			return append(late, datagram{makeReply(q, nil), addr})
+		},
+	}
+	opt = QueryOptions{Warmup: true}
+	r, err = QueryPacketConn(conn, peers[0], opt)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(1), r.Stratum)
+	assert.Equal(t, 2, len(conn.written))
+
+	conn.written = nil
+	conn.reply = func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	}
+	_, errs := QueryManyPacketConn(conn, peers, opt)
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Equal(t, 4, len(conn.written))
+}
+
+func TestOfflineLeapVersionMode(t *testing.T) {
+	cases := []struct {
+		lvm     uint8
+		leap    LeapIndicator
+		version int
+		mode    Mode
+	}{
+		{0x24, LeapNoWarning, 4, ModeServer},
+		{0x5c, LeapAddSecond, 3, ModeServer},
+		{0xa4, LeapDelSecond, 4, ModeServer},
+		{0xe4, LeapNotInSync, 4, ModeServer},
+		{0x1c, LeapNoWarning, 3, ModeServer},
+	}
+	for _, c := range cases {
+		lvm := c.lvm
+		opt := QueryOptions{
+			Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+				reply := makeReply(q, func(h *header) { h.LiVnMode = lvm })
+				return []datagram{{reply, addr}}
+			}),
+		}
+		r, err := QueryWithOptions("remote", opt)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, c.lvm, r.LeapVersionMode())
+		assert.Equal(t, c.leap, r.Leap)
+		assert.Equal(t, c.version, r.Version)
+		assert.Equal(t, c.mode, r.Mode)
+	}
+}
+
+func TestOfflineHealth(t *testing.T) {
+	valid := func() *Response {
+		r := SyntheticResponse(1250 * time.Microsecond)
+		r.Stratum = 2
+		return r
+	}
+
+	r := valid()
+	ok, summary := r.Health()
+	assert.True(t, ok)
+	assert.Equal(t, "synced, offset 1.250ms, stratum 2", summary)
+
+	cases := []struct {
+		modify  func(r *Response)
+		summary string
+	}{
+		{func(r *Response) { r.Stratum, r.KissCode = 0, "RATE" }, "rate limited"},
+		{func(r *Response) { r.Stratum, r.KissCode = 0, "DENY" }, "kiss of death (DENY)"},
+		{func(r *Response) { r.Stratum = 16 }, "not synchronized"},
+		{func(r *Response) { r.Leap = LeapNotInSync }, "not synchronized"},
+		{func(r *Response) { r.RootDispersion = 20 * time.Second }, "too imprecise"},
+		{func(r *Response) { r.ReferenceTime = r.Time.Add(-48 * time.Hour) }, "stale clock"},
+		{func(r *Response) { r.ReferenceTime = r.Time.Add(time.Second) }, "causality violation"},
+		{func(r *Response) { r.authErr = ErrAuthFailed }, "authentication failed"},
+	}
+	for _, c := range cases {
+		r := valid()
+		c.modify(r)
+		ok, summary := r.Health()
+		assert.False(t, ok, c.summary)
+		assert.Equal(t, c.summary, summary)
+	}
+}
+
+func TestOfflineDownstreamStratum(t *testing.T) {
+	cases := []struct{ stratum, downstream uint8 }{
+		{1, 2}, {2, 3}, {14, 15}, {15, 16}, {16, 16}, {255, 16},
+	}
+	for _, c := range cases {
+		r := SyntheticResponse(0)
+		r.Stratum = c.stratum
+		assert.Equal(t, c.downstream, r.DownstreamStratum())
+	}
+}
+
+func TestOfflineAgreesWith(t *testing.T) {
+	r := SyntheticResponse(0)
+	r.ClockOffset = 3 * time.Millisecond
+
+	assert.True(t, r.AgreesWith(3*time.Millisecond, 0))
+	assert.True(t, r.AgreesWith(2*time.Millisecond, time.Millisecond))
+	assert.True(t, r.AgreesWith(4*time.Millisecond, time.Millisecond))
+	assert.False(t, r.AgreesWith(1*time.Millisecond, time.Millisecond))
+	assert.False(t, r.AgreesWith(-3*time.Millisecond, 5*time.Millisecond))
+	assert.True(t, r.AgreesWith(-3*time.Millisecond, 6*time.Millisecond))
+}
+
+func TestOfflinePathToReference(t *testing.T) {
+	h := header{
+		Stratum:        2,
+		RootDelay:      0x00018000, // 1.5s
+		RootDispersion: 0x00004000, // 0.25s
+		OriginTime:     1 << 32,
+		ReceiveTime:    2 << 32,
+		TransmitTime:   2 << 32,
+	}
+	r := generateResponse(&h, 3<<32, nil)
+	delay, disp := r.PathToReference()
+	assert.Equal(t, 1500*time.Millisecond, delay)
+	assert.Equal(t, 250*time.Millisecond, disp)
+
+	// The client-to-server round trip is reported separately.
+	assert.Equal(t, 2*time.Second, r.RTT)
+}
+
+func TestOfflineTimeChecked(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.ReceiveTime = toNtpTime(time.Now().Add(time.Hour))
+				h.TransmitTime = h.ReceiveTime
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+	tm, applied, err := TimeChecked("remote", opt)
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), tm, time.Second)
+
+	// On failure, the uncorrected local time is returned.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram { return nil })
+	tm, applied, err = TimeChecked("remote", opt)
+	assert.NotNil(t, err)
+	assert.False(t, applied)
+	assert.WithinDuration(t, time.Now(), tm, time.Second)
+}
+
+func TestOfflineHighPrecision(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) {
+				h.ReceiveTime = toNtpTime(time.Now().Add(3500 * time.Microsecond))
+				h.TransmitTime = h.ReceiveTime
+			})
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, r.OffsetFloat)
+
+	opt.HighPrecision = true
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.InDelta(t, r.ClockOffset.Seconds(), r.OffsetFloat, 1e-9)
+	assert.Equal(t, offsetFloat(r.org, r.rec, r.xmt, r.dst), r.OffsetFloat)
+
+	// A sub-nanosecond offset of 3 timestamp units (~0.70ns) survives in
+	// OffsetFloat but is rounded in ClockOffset.
+	h := header{
+		Stratum:      1,
+		OriginTime:   100 << 32,
+		ReceiveTime:  100<<32 + 3,
+		TransmitTime: 100<<32 + 3,
+	}
+	r = generateResponse(&h, 100<<32, nil)
+	assert.Equal(t, time.Nanosecond, r.ClockOffset)
+	assert.Equal(t, 3.0/(1<<32), offsetFloat(r.org, r.rec, r.xmt, r.dst))
+}
+
+func TestOfflineIsLoopback(t *testing.T) {
+	cases := []struct {
+		addr     net.Addr
+		loopback bool
+	}{
+		{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 123}, true},
+		{&net.UDPAddr{IP: net.IPv4(127, 1, 2, 3), Port: 123}, true},
+		{&net.UDPAddr{IP: net.IPv6loopback, Port: 123}, true},
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}, false},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 123}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		r := Response{RemoteAddr: c.addr}
+		assert.Equal(t, c.loopback, r.IsLoopback(), "%v", c.addr)
+	}
+
+	// A query to a local server reports a loopback peer.
+	addr := startServer(t, func(q []byte) [][]byte {
+		return [][]byte{makeReply(q, nil)}
+	})
+	r, err := QueryWithOptions(addr.String(), QueryOptions{})
+	assert.Nil(t, err)
+	assert.True(t, r.IsLoopback())
+	assert.Equal(t, time.Duration(0), r.MinError)
+}
+
+func TestOfflineOriginMatchMask(t *testing.T) {
+	// A middlebox rewrites the low 16 bits of the origin timestamp.
+	mangle := func(q []byte, addr net.Addr) []datagram {
+		reply := makeReply(q, func(h *header) { h.OriginTime ^= 0xbeef })
+		return []datagram{{reply, addr}}
+	}
+	opt := QueryOptions{Dialer: fakeDialer(mangle)}
+	_, err := QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrServerResponseMismatch, err)
+
+	opt.OriginMatchMask = ^uint64(0xffff)
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Validate())
+
+	// Differences in the high bits are still detected.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		reply := makeReply(q, func(h *header) { h.OriginTime ^= 1 << 40 })
+		return []datagram{{reply, addr}}
+	})
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrServerResponseMismatch, err)
+
+	// The mask also applies to replies received on a packet connection.
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123}
+	conn := &fakePacketConn{reply: mangle}
+	_, err = QueryPacketConn(conn, peer, QueryOptions{})
+	assert.Equal(t, timeoutError{}, err)
+	_, err = QueryPacketConn(conn, peer, QueryOptions{OriginMatchMask: ^uint64(0xffff)})
+	assert.Nil(t, err)
+	_, errs := QueryManyPacketConn(conn, []net.Addr{peer}, QueryOptions{OriginMatchMask: ^uint64(0xffff)})
+	assert.Nil(t, errs[0])
+
+	// A mask keeping a single bit can distinguish only two queries.
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 123},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: 123},
+	}
+	conn = &fakePacketConn{reply: func(q []byte, addr net.Addr) []datagram {
+		return []datagram{{makeReply(q, nil), addr}}
+	}}
+	responses, errs := QueryManyPacketConn(conn, addrs, QueryOptions{OriginMatchMask: 1})
+	assert.Equal(t, 2, len(conn.written))
+	assert.Nil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.NotNil(t, responses[0])
+	assert.NotNil(t, responses[1])
+	assert.Nil(t, responses[2])
+	assert.Equal(t, ErrTooManyQueries, errs[2])
+}
+
+func TestOfflinePollExponent(t *testing.T) {
+	cases := []struct {
+		interval time.Duration
+		exp      int8
+	}{
+		{16 * time.Second, 4},
+		{64 * time.Second, 6},
+		{1024 * time.Second, 10},
+		{90 * time.Second, 6}, // log2(90) ~ 6.49
+		{91 * time.Second, 7}, // log2(91) ~ 6.51
+		{time.Second, 4},      // clamped
+		{0, 4},                // clamped
+		{-time.Minute, 4},     // clamped
+		{48 * time.Hour, 17},  // clamped
+		{maxPollInterval, 17},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.exp, PollExponent(c.interval), c.interval.String())
+	}
+
+	// Intervals round-trip through their exponents.
+	for exp := int8(4); exp <= 17; exp++ {
+		interval := PollInterval(exp)
+		assert.Equal(t, time.Duration(1<<uint(exp))*time.Second, interval)
+		assert.Equal(t, exp, PollExponent(interval))
+	}
+}
+
+func TestOfflineSendRecvInstant(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			time.Sleep(10 * time.Millisecond)
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	before := time.Now()
+	r, err := QueryWithOptions("remote", opt)
+	after := time.Now()
+	assert.Nil(t, err)
+
+	assert.False(t, r.SendInstant.Before(before))
+	assert.True(t, r.RecvInstant.After(r.SendInstant))
+	assert.False(t, r.RecvInstant.After(after))
+
+	// The monotonic duration of the exchange approximates the RTT.
+	elapsed := r.RecvInstant.Sub(r.SendInstant)
+	assert.True(t, elapsed >= 10*time.Millisecond)
+	assert.InDelta(t, float64(r.RTT), float64(elapsed), float64(time.Millisecond))
+}
+
+func TestOfflineIsReachable(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	assert.True(t, IsReachable("remote", opt))
+
+	// Timeouts and invalid responses both count as unreachable.
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram { return nil })
+	assert.False(t, IsReachable("remote", opt))
+	opt.Dialer = fakeDialer(func(q []byte, addr net.Addr) []datagram {
+		reply := makeReply(q, func(h *header) { h.Stratum = 16 })
+		return []datagram{{reply, addr}}
+	})
+	assert.False(t, IsReachable("remote", opt))
+}
+
+func TestOfflineAcceptVersions(t *testing.T) {
+	version := 3
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			reply := makeReply(q, func(h *header) { h.setVersion(version) })
+			return []datagram{{reply, addr}}
+		}),
+	}
+
+	// By default, any version is accepted.
+	r, err := QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, r.Version)
+
+	opt.AcceptVersions = []int{4}
+	r, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, r)
+	assert.Equal(t, ErrVersionMismatch, err)
+	assert.Equal(t, ClassInvalidResponse, ClassifyError(err))
+
+	version = 4
+	_, err = QueryWithOptions("remote", opt)
+	assert.Nil(t, err)
+
+	opt.AcceptVersions = []int{3, 4}
+	for _, version = range []int{3, 4} {
+		_, err = QueryWithOptions("remote", opt)
+		assert.Nil(t, err)
+	}
+	version = 2
+	_, err = QueryWithOptions("remote", opt)
+	assert.Equal(t, ErrVersionMismatch, err)
+}
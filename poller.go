@@ -0,0 +1,538 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of recent poll results retained by a Poller.
+	pollHistorySize = 32
+
+	// The maximum rate at which a disciplined clock is slewed (500 PPM).
+	// Changes in offset faster than this can't be explained by drift or
+	// slewing and indicate the clock was stepped.
+	maxSlewRate = 500e-6
+)
+
+// A Poller repeatedly queries a single NTP server and keeps track of the
+// results. It retains a rolling window of the most recent results as well
+// as aggregate statistics covering its entire lifetime. A Poller is safe for
+// concurrent use.
+type Poller struct {
+	// OnStratumChange is an optional callback invoked when a response
+	// reports a different stratum than the previous response, for example
+	// when a server loses synchronization and falls back to stratum 16.
+	// "Kiss of death" responses and failed polls are ignored. It should be
+	// set before polling begins.
+	OnStratumChange func(old, new uint8)
+
+	host string
+	opt  QueryOptions
+
+	mu        sync.Mutex
+	history   []pollResult // oldest first
+	stats     PollerStats
+	offsetSum float64
+	rttSum    float64
+	jitter    float64
+	rand      *rand.Rand
+	stratum   uint8 // stratum of the most recent response, if nonzero
+
+	// Resolved addresses, polled round-robin.
+	resolveInterval time.Duration
+	resolvedAt      time.Time
+	addrs           []string
+	next            int
+}
+
+// A pollResult records the outcome of a single poll.
+type pollResult struct {
+	time time.Time // local system time of the poll
+	r    *Response
+	err  error
+}
+
+// PollerStats contains aggregate statistics covering all polls issued by a
+// Poller.
+type PollerStats struct {
+	// Total is the number of polls issued.
+	Total int
+
+	// Valid is the number of polls that produced a response passing
+	// validation.
+	Valid int
+
+	// Timeouts is the number of polls that failed because the server didn't
+	// respond in time.
+	Timeouts int
+
+	// KissOfDeath is the number of "kiss of death" responses received.
+	KissOfDeath int
+
+	// MinOffset, MaxOffset and MeanOffset summarize the clock offsets of all
+	// valid responses.
+	MinOffset  time.Duration
+	MaxOffset  time.Duration
+	MeanOffset time.Duration
+
+	// MinRTT, MaxRTT and MeanRTT summarize the round-trip times of all valid
+	// responses.
+	MinRTT  time.Duration
+	MaxRTT  time.Duration
+	MeanRTT time.Duration
+
+	// LastSuccess is the local system time of the most recent poll that
+	// produced a valid response.
+	LastSuccess time.Time
+}
+
+// NewPoller creates a Poller that queries the server at the given address
+// using the provided options. See QueryWithOptions for a description of the
+// address format.
+func NewPoller(address string, opt QueryOptions) *Poller {
+	return &Poller{host: address, opt: opt}
+}
+
+// Poll queries the server once and records the result.
+func (p *Poller) Poll() (*Response, error) {
+	address, err := p.nextAddress()
+	if err != nil {
+		p.record(time.Now(), nil, err)
+		return nil, err
+	}
+	r, err := QueryWithOptions(address, p.opt)
+	p.record(time.Now(), r, err)
+	return r, err
+}
+
+// SetResolveInterval causes the Poller to resolve the server's host name
+// itself and to poll each of its IP addresses in turn, re-resolving the
+// host name only after the interval has elapsed. This provides stable
+// per-address measurements of a host name with several addresses, such as
+// an NTP pool zone, while still adapting to changes in DNS. If a refresh
+// fails, the previously resolved addresses continue to be used. An
+// interval of zero, the default, resolves the host name on every poll. The
+// host name is resolved with the Resolver in the Poller's QueryOptions.
+func (p *Poller) SetResolveInterval(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.resolveInterval = interval
+	p.addrs = nil
+}
+
+// nextAddress returns the address to use for the next poll.
+func (p *Poller) nextAddress() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resolveInterval <= 0 {
+		return p.host, nil
+	}
+
+	if p.addrs == nil || time.Since(p.resolvedAt) >= p.resolveInterval {
+		addrs, err := p.resolve()
+		switch {
+		case err == nil:
+			p.addrs, p.next = addrs, 0
+			p.resolvedAt = time.Now()
+		case p.addrs == nil:
+			return "", err
+		}
+	}
+
+	address := p.addrs[p.next%len(p.addrs)]
+	p.next++
+	return address, nil
+}
+
+// resolve looks up the IP addresses of the Poller's host and returns them
+// as a list of "host:port" addresses.
+func (p *Poller) resolve() ([]string, error) {
+	port := p.opt.Port
+	if port == 0 {
+		port = defaultNtpPort
+	}
+	address, err := fixHostPort(p.host, port)
+	if err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupHost(p.opt.Resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), portStr)
+	}
+	return addrs, nil
+}
+
+// SetJitter configures the random jitter applied by NextInterval. Each
+// interval is varied uniformly by up to the given fraction of its length
+// in either direction, so a fraction of 0.1 produces intervals within 10%
+// of the requested one. The fraction is clamped to the range [0, 1]. Random
+// values are drawn from src, or from a source seeded with the current time
+// if src is nil.
+func (p *Poller) SetJitter(fraction float64, src rand.Source) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	p.jitter = math.Max(0, math.Min(1, fraction))
+	p.rand = rand.New(src)
+}
+
+// NextInterval returns the time the caller should wait before polling
+// again, given the desired interval between polls. The interval is varied
+// by the jitter configured with SetJitter. Jitter prevents many clients
+// started at the same time from repeatedly polling a server in unison,
+// which may cause the server to rate limit them.
+func (p *Poller) NextInterval(interval time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.jitter == 0 {
+		return interval
+	}
+	scale := 1 + p.jitter*(2*p.rand.Float64()-1)
+	return time.Duration(float64(interval) * scale)
+}
+
+// Stats returns aggregate statistics covering all polls issued by the
+// Poller.
+func (p *Poller) Stats() PollerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	if s.Valid > 0 {
+		s.MeanOffset = time.Duration(p.offsetSum / float64(s.Valid))
+		s.MeanRTT = time.Duration(p.rttSum / float64(s.Valid))
+	}
+	return s
+}
+
+// Reach returns a reachability register in the style of the reference NTP
+// implementation. Each bit represents one of the eight most recent polls,
+// with the most recent poll in the lowest bit. A bit is set if the server
+// responded to the poll. A value of 0377 (octal) indicates the server
+// responded to each of the last eight polls.
+func (p *Poller) Reach() uint8 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var reach uint8
+	start := len(p.history) - 8
+	if start < 0 {
+		start = 0
+	}
+	for _, h := range p.history[start:] {
+		reach <<= 1
+		if h.err == nil {
+			reach |= 1
+		}
+	}
+	return reach
+}
+
+// LossRate returns the fraction of the polls in the Poller's recent history
+// that were lost at the network layer, because the server didn't respond
+// before the timeout or its host refused the connection. Polls that
+// received a response are not counted as lost, even if the response was
+// rejected. Polls that failed for other reasons, such as a DNS failure,
+// are not counted as lost either. It returns 0 if no polls have been
+// issued.
+func (p *Poller) LossRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.history) == 0 {
+		return 0
+	}
+	lost := 0
+	for _, h := range p.history {
+		switch ClassifyError(h.err) {
+		case ClassTimeout, ClassRefused:
+			lost++
+		}
+	}
+	return float64(lost) / float64(len(p.history))
+}
+
+// InferredMinPoll estimates the server's minimum accepted poll interval
+// from the Poller's recent history. The interval preceding each poll is
+// compared with the server's reply: the estimate is the shortest interval
+// that drew a non-RATE reply while exceeding every interval that drew a
+// RATE "kiss of death" response. It returns 0 if the server hasn't rate
+// limited the Poller or if no poll has yet succeeded at a longer interval.
+func (p *Poller) InferredMinPoll() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var rateMax time.Duration
+	limited := false
+	for i := 1; i < len(p.history); i++ {
+		h := p.history[i]
+		if h.err == nil && h.r.KissCode == "RATE" {
+			if d := h.time.Sub(p.history[i-1].time); d > rateMax {
+				rateMax = d
+			}
+			limited = true
+		}
+	}
+	if !limited {
+		return 0
+	}
+
+	var minPoll time.Duration
+	for i := 1; i < len(p.history); i++ {
+		h := p.history[i]
+		if h.err != nil || h.r.KissCode == "RATE" {
+			continue
+		}
+		d := h.time.Sub(p.history[i-1].time)
+		if d > rateMax && (minPoll == 0 || d < minPoll) {
+			minPoll = d
+		}
+	}
+	return minPoll
+}
+
+// DetectedStep reports whether the local clock appears to have been stepped
+// between the two most recent valid responses, for example by another time
+// synchronization agent. A step is detected when the change in ClockOffset
+// exceeds the maximum change that could be caused by the clock being slewed
+// at 500 PPM over the interval between the polls, plus half the sum of the
+// two round-trip times. It also returns the change in ClockOffset.
+func (p *Poller) DetectedStep() (bool, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var last, prev *pollResult
+	for i := len(p.history) - 1; i >= 0 && prev == nil; i-- {
+		h := &p.history[i]
+		if h.err != nil || h.r.Validate() != nil {
+			continue
+		}
+		if last == nil {
+			last = h
+		} else {
+			prev = h
+		}
+	}
+	if prev == nil {
+		return false, 0
+	}
+
+	change := last.r.ClockOffset - prev.r.ClockOffset
+	allowance := time.Duration(maxSlewRate*float64(last.time.Sub(prev.time))) +
+		(last.r.RTT+prev.r.RTT)/2
+	if change > allowance || change < -allowance {
+		return true, change
+	}
+	return false, change
+}
+
+// ServerStability estimates the frequency stability of the server's clock,
+// in parts per million, from the Poller's recent history. For each pair of
+// consecutive valid responses, it computes the server's apparent frequency
+// error: the rate at which the server's transmit timestamps progressed
+// relative to the local time elapsed between the polls. It returns the
+// standard deviation of these frequency errors. A server whose clock runs
+// at a steady rate, even a rate differing from the local clock's, has a
+// stability near zero. It returns 0 if fewer than three valid responses
+// are available.
+func (p *Poller) ServerStability() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var freqs []float64
+	var prev *pollResult
+	for i := range p.history {
+		h := &p.history[i]
+		if h.err != nil || h.r.Validate() != nil {
+			continue
+		}
+		if prev != nil {
+			local := h.time.Sub(prev.time)
+			server := h.r.Time.Sub(prev.r.Time)
+			if local > 0 {
+				freqs = append(freqs, 1e6*float64(server-local)/float64(local))
+			}
+		}
+		prev = h
+	}
+	if len(freqs) < 2 {
+		return 0
+	}
+
+	var mean float64
+	for _, f := range freqs {
+		mean += f
+	}
+	mean /= float64(len(freqs))
+
+	var variance float64
+	for _, f := range freqs {
+		variance += (f - mean) * (f - mean)
+	}
+	variance /= float64(len(freqs) - 1)
+	return math.Sqrt(variance)
+}
+
+// AverageServerDelay returns the mean ServerProcessingDelay of the valid
+// responses in the Poller's recent history. Because the history covers only
+// the most recent polls, a rising value may indicate the server is becoming
+// overloaded. It returns 0 if there are no valid responses.
+func (p *Poller) AverageServerDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sum time.Duration
+	n := 0
+	for _, h := range p.history {
+		if h.err != nil || h.r.Validate() != nil {
+			continue
+		}
+		sum += h.r.ServerProcessingDelay()
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / time.Duration(n)
+}
+
+// RootDispersionTrend returns the rate at which the RootDispersion reported
+// by the server has been changing over the Poller's recent history, in
+// seconds of dispersion per second. It is the slope of a least-squares fit
+// of the valid responses' RootDispersion values against the times of the
+// polls. A positive trend suggests the server is losing synchronization
+// with its own sources, while a falling trend suggests it recently
+// synchronized. It returns 0 if fewer than two valid responses are
+// available.
+func (p *Poller) RootDispersionTrend() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var xs, ys []float64
+	for _, h := range p.history {
+		if h.err != nil || h.r.Validate() != nil {
+			continue
+		}
+		xs = append(xs, h.time.Sub(p.history[0].time).Seconds())
+		ys = append(ys, h.r.RootDispersion.Seconds())
+	}
+	if len(xs) < 2 {
+		return 0
+	}
+
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= float64(len(xs))
+	my /= float64(len(ys))
+
+	var sxy, sxx float64
+	for i := range xs {
+		sxy += (xs[i] - mx) * (ys[i] - my)
+		sxx += (xs[i] - mx) * (xs[i] - mx)
+	}
+	if sxx == 0 {
+		return 0
+	}
+	return sxy / sxx
+}
+
+// LeapHistory returns the leap indicators reported by the server in the
+// Poller's recent history, oldest first. It may be used to verify that a
+// server sets a leap second warning ahead of a scheduled leap second and
+// clears it afterward. Failed polls and kiss of death responses are
+// omitted. At most pollHistorySize indicators are returned.
+func (p *Poller) LeapHistory() []LeapIndicator {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var leaps []LeapIndicator
+	for _, h := range p.history {
+		if h.err != nil || h.r.IsKissOfDeath() {
+			continue
+		}
+		leaps = append(leaps, h.r.Leap)
+	}
+	return leaps
+}
+
+// record adds the result of a poll issued at time t to the Poller's history
+// and statistics, and reports any change in the server's stratum.
+func (p *Poller) record(t time.Time, r *Response, err error) {
+	old, changed := p.update(t, r, err)
+	if changed && p.OnStratumChange != nil {
+		p.OnStratumChange(old, r.Stratum)
+	}
+}
+
+// update adds the result of a poll to the Poller's history and statistics.
+// It returns the previous stratum and whether the response's stratum
+// differs from it.
+func (p *Poller) update(t time.Time, r *Response, err error) (old uint8, changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil && !r.IsKissOfDeath() {
+		old = p.stratum
+		changed = old != 0 && old != r.Stratum
+		p.stratum = r.Stratum
+	}
+
+	p.history = append(p.history, pollResult{time: t, r: r, err: err})
+	if len(p.history) > pollHistorySize {
+		p.history = p.history[len(p.history)-pollHistorySize:]
+	}
+
+	s := &p.stats
+	s.Total++
+	switch {
+	case err != nil:
+		if ClassifyError(err) == ClassTimeout {
+			s.Timeouts++
+		}
+	case r.IsKissOfDeath():
+		s.KissOfDeath++
+	case r.Validate() == nil:
+		if s.Valid == 0 || r.ClockOffset < s.MinOffset {
+			s.MinOffset = r.ClockOffset
+		}
+		if s.Valid == 0 || r.ClockOffset > s.MaxOffset {
+			s.MaxOffset = r.ClockOffset
+		}
+		if s.Valid == 0 || r.RTT < s.MinRTT {
+			s.MinRTT = r.RTT
+		}
+		if s.Valid == 0 || r.RTT > s.MaxRTT {
+			s.MaxRTT = r.RTT
+		}
+		s.Valid++
+		s.LastSuccess = t
+		p.offsetSum += float64(r.ClockOffset)
+		p.rttSum += float64(r.RTT)
+	}
+	return old, changed
+}
@@ -0,0 +1,429 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// responseWith returns a valid synthetic response with the given clock
+// offset and round-trip time.
+func responseWith(offset, rtt time.Duration) *Response {
+	r := SyntheticResponse(offset)
+	r.RTT = rtt
+	return r
+}
+
+func TestOfflinePollerStats(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, PollerStats{}, p.Stats())
+
+	kod := SyntheticResponse(0)
+	kod.Stratum = 0
+
+	start := time.Now()
+	p.record(start, responseWith(10*time.Millisecond, 20*time.Millisecond), nil)
+	p.record(start.Add(1*time.Minute), nil, timeoutError{})
+	p.record(start.Add(2*time.Minute), responseWith(-30*time.Millisecond, 40*time.Millisecond), nil)
+	p.record(start.Add(3*time.Minute), kod, nil)
+	p.record(start.Add(4*time.Minute), responseWith(50*time.Millisecond, 30*time.Millisecond), nil)
+	p.record(start.Add(5*time.Minute), nil, errors.New("network unreachable"))
+
+	s := p.Stats()
+	assert.Equal(t, 6, s.Total)
+	assert.Equal(t, 3, s.Valid)
+	assert.Equal(t, 1, s.Timeouts)
+	assert.Equal(t, 1, s.KissOfDeath)
+	assert.Equal(t, -30*time.Millisecond, s.MinOffset)
+	assert.Equal(t, 50*time.Millisecond, s.MaxOffset)
+	assert.Equal(t, 10*time.Millisecond, s.MeanOffset)
+	assert.Equal(t, 20*time.Millisecond, s.MinRTT)
+	assert.Equal(t, 40*time.Millisecond, s.MaxRTT)
+	assert.Equal(t, 30*time.Millisecond, s.MeanRTT)
+	assert.Equal(t, start.Add(4*time.Minute), s.LastSuccess)
+
+	// Statistics cover the Poller's lifetime, not just its history window.
+	for i := 0; i < 2*pollHistorySize; i++ {
+		p.record(start.Add(time.Hour), nil, timeoutError{})
+	}
+	s = p.Stats()
+	assert.Equal(t, 6+2*pollHistorySize, s.Total)
+	assert.Equal(t, 3, s.Valid)
+	assert.Equal(t, pollHistorySize, len(p.history))
+}
+
+func TestOfflinePollerPoll(t *testing.T) {
+	opt := QueryOptions{
+		Dialer: fakeDialer(func(q []byte, addr net.Addr) []datagram {
+			return []datagram{{makeReply(q, nil), addr}}
+		}),
+	}
+	p := NewPoller("remote", opt)
+	r, err := p.Poll()
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+
+	s := p.Stats()
+	assert.Equal(t, 1, s.Total)
+	assert.Equal(t, 1, s.Valid)
+	assert.Equal(t, r.ClockOffset, s.MeanOffset)
+}
+
+func TestOfflinePollerReach(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, uint8(0), p.Reach())
+
+	// Results are listed oldest first.
+	results := []bool{true, true, false, true}
+	for _, ok := range results {
+		if ok {
+			p.record(time.Now(), SyntheticResponse(0), nil)
+		} else {
+			p.record(time.Now(), nil, timeoutError{})
+		}
+	}
+	assert.Equal(t, uint8(0b1101), p.Reach())
+
+	// Only the last eight polls are reflected in the register.
+	for i := 0; i < 8; i++ {
+		p.record(time.Now(), SyntheticResponse(0), nil)
+	}
+	assert.Equal(t, uint8(0377), p.Reach())
+
+	p.record(time.Now(), nil, timeoutError{})
+	p.record(time.Now(), nil, timeoutError{})
+	assert.Equal(t, uint8(0374), p.Reach())
+}
+
+func TestOfflinePollerLossRate(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, 0.0, p.LossRate())
+
+	// Rejected responses and DNS failures aren't losses.
+	p.record(time.Now(), SyntheticResponse(0), nil)
+	p.record(time.Now(), nil, timeoutError{})
+	p.record(time.Now(), SyntheticResponse(0), ErrInvalidStratum)
+	p.record(time.Now(), nil, &net.DNSError{Err: "no such host"})
+	p.record(time.Now(), nil, timeoutError{})
+	assert.Equal(t, 0.4, p.LossRate())
+
+	// The rate covers only the recent history.
+	for i := 0; i < pollHistorySize; i++ {
+		p.record(time.Now(), nil, timeoutError{})
+	}
+	assert.Equal(t, 1.0, p.LossRate())
+}
+
+func TestOfflinePollerInferredMinPoll(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	rate := SyntheticResponse(0)
+	rate.Stratum = 0
+	rate.KissCode = "RATE"
+
+	// Script a server that rate limits polls arriving less than 32 seconds
+	// apart.
+	intervals := []time.Duration{8, 16, 64, 32, 16, 128}
+	now := time.Now()
+	p.record(now, SyntheticResponse(0), nil)
+	assert.Equal(t, time.Duration(0), p.InferredMinPoll())
+	for _, iv := range intervals {
+		now = now.Add(iv * time.Second)
+		if iv < 32 {
+			p.record(now, rate, nil)
+		} else {
+			p.record(now, SyntheticResponse(0), nil)
+		}
+	}
+	assert.Equal(t, 32*time.Second, p.InferredMinPoll())
+
+	// Without any RATE responses, there's nothing to infer.
+	p = NewPoller("remote", QueryOptions{})
+	for i := 0; i < 4; i++ {
+		p.record(now.Add(time.Duration(i)*time.Second), SyntheticResponse(0), nil)
+	}
+	assert.Equal(t, time.Duration(0), p.InferredMinPoll())
+
+	// Nor when every poll has been rate limited.
+	p = NewPoller("remote", QueryOptions{})
+	for i := 0; i < 4; i++ {
+		p.record(now.Add(time.Duration(i)*time.Second), rate, nil)
+	}
+	assert.Equal(t, time.Duration(0), p.InferredMinPoll())
+}
+
+func TestOfflinePollerDetectedStep(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	step, _ := p.DetectedStep()
+	assert.False(t, step)
+
+	// Gradual drift over a 64 second poll interval isn't a step.
+	now := time.Now()
+	p.record(now, responseWith(10*time.Millisecond, 20*time.Millisecond), nil)
+	now = now.Add(64 * time.Second)
+	p.record(now, responseWith(12*time.Millisecond, 20*time.Millisecond), nil)
+	step, change := p.DetectedStep()
+	assert.False(t, step)
+	assert.Equal(t, 2*time.Millisecond, change)
+
+	// Failed polls are skipped when detecting a step.
+	now = now.Add(64 * time.Second)
+	p.record(now, nil, timeoutError{})
+
+	// An abrupt jump in offset indicates the local clock was stepped.
+	now = now.Add(64 * time.Second)
+	p.record(now, responseWith(-490*time.Millisecond, 20*time.Millisecond), nil)
+	step, change = p.DetectedStep()
+	assert.True(t, step)
+	assert.Equal(t, -502*time.Millisecond, change)
+
+	// Subsequent polls are consistent with the new offset.
+	now = now.Add(64 * time.Second)
+	p.record(now, responseWith(-489*time.Millisecond, 20*time.Millisecond), nil)
+	step, _ = p.DetectedStep()
+	assert.False(t, step)
+}
+
+func TestOfflinePollerServerStability(t *testing.T) {
+	const interval = 64 * time.Second
+	ppm := func(f float64) time.Duration {
+		return time.Duration(f * float64(interval) / 1e6)
+	}
+
+	// record polls the server every 64 seconds, with the server's clock
+	// progressing at the given frequency errors (in ppm) between polls.
+	record := func(p *Poller, freqs ...float64) {
+		local := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		server := local
+		r := SyntheticResponse(0)
+		r.Time, r.ReferenceTime = server, server
+		p.record(local, r, nil)
+		for _, f := range freqs {
+			local = local.Add(interval)
+			server = server.Add(interval + ppm(f))
+			r := SyntheticResponse(0)
+			r.Time, r.ReferenceTime = server, server
+			p.record(local, r, nil)
+		}
+	}
+
+	// A server whose clock drifts at a constant rate is stable.
+	p := NewPoller("remote", QueryOptions{})
+	record(p, 50, 50, 50, 50)
+	assert.InDelta(t, 0, p.ServerStability(), 1e-6)
+
+	// A wandering clock is less stable. The sample standard deviation of
+	// {10, -10, 10, -10} is sqrt(400/3).
+	p = NewPoller("remote", QueryOptions{})
+	record(p, 10, -10, 10, -10)
+	assert.InDelta(t, 11.547, p.ServerStability(), 1e-3)
+
+	// Failed polls are skipped.
+	p.record(time.Now(), nil, timeoutError{})
+	assert.InDelta(t, 11.547, p.ServerStability(), 1e-3)
+
+	// Too few samples.
+	p = NewPoller("remote", QueryOptions{})
+	record(p, 10)
+	assert.Equal(t, 0.0, p.ServerStability())
+}
+
+func TestOfflinePollerAverageServerDelay(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, time.Duration(0), p.AverageServerDelay())
+
+	// withDelay returns a valid response whose server took the given time
+	// to process the query.
+	withDelay := func(d time.Duration) *Response {
+		r := SyntheticResponse(0)
+		r.xmt = r.rec + toNtpTime(ntpEra0.Add(d))
+		return r
+	}
+
+	// The server's processing delay rises steadily.
+	for i := 1; i <= 4; i++ {
+		p.record(time.Now(), withDelay(time.Duration(i)*time.Millisecond), nil)
+	}
+	p.record(time.Now(), nil, timeoutError{})
+	assert.Equal(t, 2500*time.Microsecond, p.AverageServerDelay())
+
+	// Once the history is filled with slower responses, the average
+	// reflects only the recent polls.
+	for i := 0; i < pollHistorySize; i++ {
+		p.record(time.Now(), withDelay(40*time.Millisecond), nil)
+	}
+	assert.Equal(t, 40*time.Millisecond, p.AverageServerDelay())
+}
+
+func TestOfflinePollerNextInterval(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, 64*time.Second, p.NextInterval(64*time.Second))
+
+	// Intervals vary within the jitter bound.
+	p.SetJitter(0.25, rand.NewSource(1))
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := p.NextInterval(64 * time.Second)
+		assert.True(t, d >= 48*time.Second && d <= 80*time.Second, d.String())
+		seen[d] = true
+	}
+	assert.True(t, len(seen) > 90)
+
+	// The same seed produces the same intervals.
+	q := NewPoller("remote", QueryOptions{})
+	q.SetJitter(0.25, rand.NewSource(1))
+	p.SetJitter(0.25, rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, p.NextInterval(time.Minute), q.NextInterval(time.Minute))
+	}
+
+	// The fraction is clamped.
+	p.SetJitter(5, nil)
+	for i := 0; i < 100; i++ {
+		d := p.NextInterval(time.Minute)
+		assert.True(t, d >= 0 && d <= 2*time.Minute, d.String())
+	}
+	p.SetJitter(-1, nil)
+	assert.Equal(t, time.Minute, p.NextInterval(time.Minute))
+}
+
+func TestOfflinePollerOnStratumChange(t *testing.T) {
+	type change struct{ old, new uint8 }
+	var changes []change
+	p := NewPoller("remote", QueryOptions{})
+	p.OnStratumChange = func(old, new uint8) {
+		changes = append(changes, change{old, new})
+	}
+
+	withStratum := func(stratum uint8) *Response {
+		r := SyntheticResponse(0)
+		r.Stratum = stratum
+		return r
+	}
+
+	// The server loses sync, then recovers at a different stratum. Failed
+	// polls and kiss of death responses don't count as changes.
+	p.record(time.Now(), withStratum(2), nil)
+	p.record(time.Now(), withStratum(2), nil)
+	p.record(time.Now(), nil, timeoutError{})
+	p.record(time.Now(), withStratum(16), nil)
+	p.record(time.Now(), withStratum(0), nil)
+	p.record(time.Now(), withStratum(16), nil)
+	p.record(time.Now(), withStratum(3), nil)
+
+	assert.Equal(t, []change{{2, 16}, {16, 3}}, changes)
+}
+
+func TestOfflinePollerResolveInterval(t *testing.T) {
+	res := &fakeResolver{ips: []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)}}
+	var dialed []string
+	p := NewPoller("pool.example", QueryOptions{
+		Resolver: res,
+		Dialer: func(la, ra string) (net.Conn, error) {
+			dialed = append(dialed, ra)
+			return fakeDialer(func(q []byte, addr net.Addr) []datagram {
+				return []datagram{{makeReply(q, nil), addr}}
+			})(la, ra)
+		},
+	})
+	p.SetResolveInterval(time.Hour)
+
+	// The host is resolved once and its addresses are polled in turn.
+	for i := 0; i < 3; i++ {
+		_, err := p.Poll()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"192.0.2.1:123", "192.0.2.2:123", "192.0.2.1:123"}, dialed)
+	assert.Equal(t, []string{"pool.example"}, res.hosts)
+
+	// Once the interval elapses, the host is resolved again.
+	res.ips = []net.IP{net.IPv4(192, 0, 2, 3)}
+	p.resolvedAt = p.resolvedAt.Add(-time.Hour)
+	_, err := p.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.3:123", dialed[3])
+	assert.Equal(t, 2, len(res.hosts))
+
+	// A failed refresh keeps the previous addresses.
+	res.ips = nil
+	p.resolvedAt = p.resolvedAt.Add(-time.Hour)
+	_, err = p.Poll()
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.3:123", dialed[4])
+
+	// Without any addresses, the poll fails.
+	p.SetResolveInterval(time.Hour)
+	_, err = p.Poll()
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr))
+	assert.Equal(t, 6, p.Stats().Total)
+}
+
+func TestOfflinePollerRootDispersionTrend(t *testing.T) {
+	record := func(p *Poller, disps ...time.Duration) {
+		start := time.Now()
+		for i, d := range disps {
+			r := SyntheticResponse(0)
+			r.RootDispersion = d
+			p.record(start.Add(time.Duration(i)*100*time.Second), r, nil)
+		}
+	}
+
+	// Dispersion climbing by 1ms every 100 seconds.
+	p := NewPoller("remote", QueryOptions{})
+	assert.Equal(t, 0.0, p.RootDispersionTrend())
+	record(p, 5*time.Millisecond, 6*time.Millisecond, 7*time.Millisecond, 8*time.Millisecond)
+	assert.InDelta(t, 1e-5, p.RootDispersionTrend(), 1e-12)
+
+	// Dispersion falling after the server resynchronizes.
+	p = NewPoller("remote", QueryOptions{})
+	record(p, 50*time.Millisecond, 30*time.Millisecond, 10*time.Millisecond)
+	assert.InDelta(t, -2e-4, p.RootDispersionTrend(), 1e-12)
+
+	// Steady dispersion.
+	p = NewPoller("remote", QueryOptions{})
+	record(p, 5*time.Millisecond, 5*time.Millisecond)
+	assert.InDelta(t, 0, p.RootDispersionTrend(), 1e-12)
+}
+
+func TestOfflinePollerLeapHistory(t *testing.T) {
+	p := NewPoller("remote", QueryOptions{})
+	assert.Nil(t, p.LeapHistory())
+
+	withLeap := func(leap LeapIndicator) *Response {
+		r := SyntheticResponse(0)
+		r.Leap = leap
+		return r
+	}
+	kod := SyntheticResponse(0)
+	kod.Stratum = 0
+	kod.KissCode = "RATE"
+
+	// The server raises a leap second warning, then clears it after the
+	// event. Failed polls and kiss of death responses are skipped.
+	p.record(time.Now(), withLeap(LeapNoWarning), nil)
+	p.record(time.Now(), withLeap(LeapAddSecond), nil)
+	p.record(time.Now(), nil, timeoutError{})
+	p.record(time.Now(), withLeap(LeapAddSecond), nil)
+	p.record(time.Now(), kod, nil)
+	p.record(time.Now(), withLeap(LeapNoWarning), nil)
+
+	assert.Equal(t, []LeapIndicator{
+		LeapNoWarning, LeapAddSecond, LeapAddSecond, LeapNoWarning,
+	}, p.LeapHistory())
+
+	// The history is bounded.
+	for i := 0; i < 2*pollHistorySize; i++ {
+		p.record(time.Now(), withLeap(LeapDelSecond), nil)
+	}
+	leaps := p.LeapHistory()
+	assert.Len(t, leaps, pollHistorySize)
+	assert.Equal(t, LeapIndicator(LeapDelSecond), leaps[0])
+}
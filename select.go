@@ -0,0 +1,202 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"sort"
+	"time"
+)
+
+// WeightedOffset combines the clock offsets reported by several servers
+// into a single estimate. Invalid responses are ignored, as are
+// "falsetickers" whose correctness intervals (ClockOffset plus or minus
+// RootDistance) don't overlap the interval agreed on by a majority of the
+// valid responses. Each remaining offset is weighted by the inverse of its
+// RootDistance, so that servers with lower distances contribute more to
+// the result. It returns 0 if no majority of valid responses agrees.
+func WeightedOffset(responses []*Response) time.Duration {
+	var sum, weights float64
+	for _, r := range truechimers(responses) {
+		dist := r.RootDistance
+		if dist < time.Nanosecond {
+			dist = time.Nanosecond
+		}
+		w := 1 / float64(dist)
+		sum += w * float64(r.ClockOffset)
+		weights += w
+	}
+	if weights == 0 {
+		return 0
+	}
+	return time.Duration(sum / weights)
+}
+
+// A SelectionPolicy determines which of the truechimers surviving
+// SelectTruechimers is chosen as the authoritative response.
+type SelectionPolicy int
+
+const (
+	// PolicyLowestStratum chooses the response from the server closest to
+	// its reference clock.
+	PolicyLowestStratum SelectionPolicy = iota
+
+	// PolicyLowestRTT chooses the response with the shortest round trip
+	// delay.
+	PolicyLowestRTT
+
+	// PolicyClosestToMedian chooses the response whose clock offset is
+	// closest to the median offset of the truechimers.
+	PolicyClosestToMedian
+)
+
+// SelectTruechimers discards invalid responses and falsetickers in the
+// manner of WeightedOffset, then uses the policy to choose a single
+// authoritative response from the remaining truechimers. Ties are broken
+// in favor of the response with the lower RootDistance, and then the
+// response appearing first in responses. It returns nil if the policy is
+// unknown or if no majority of valid responses agrees.
+func SelectTruechimers(responses []*Response, policy SelectionPolicy) *Response {
+	candidates := truechimers(responses)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Lower scores are preferred.
+	var score func(r *Response) int64
+	switch policy {
+	case PolicyLowestStratum:
+		score = func(r *Response) int64 { return int64(r.Stratum) }
+	case PolicyLowestRTT:
+		score = func(r *Response) int64 { return int64(r.RTT) }
+	case PolicyClosestToMedian:
+		median := medianOffset(candidates)
+		score = func(r *Response) int64 {
+			d := r.ClockOffset - median
+			if d < 0 {
+				d = -d
+			}
+			return int64(d)
+		}
+	default:
+		return nil
+	}
+
+	best := candidates[0]
+	for _, r := range candidates[1:] {
+		sr, sb := score(r), score(best)
+		if sr < sb || (sr == sb && r.RootDistance < best.RootDistance) {
+			best = r
+		}
+	}
+	return best
+}
+
+// medianOffset returns the median clock offset of the responses.
+func medianOffset(responses []*Response) time.Duration {
+	offsets := make([]time.Duration, len(responses))
+	for i, r := range responses {
+		offsets[i] = r.ClockOffset
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	n := len(offsets)
+	if n%2 == 1 {
+		return offsets[n/2]
+	}
+	a, b := offsets[n/2-1], offsets[n/2]
+	return a + (b-a)/2
+}
+
+// IntersectIntervals uses Marzullo's algorithm to find the smallest
+// interval contained by the largest number of the given [low, high]
+// intervals, such as the correctness intervals of several clock offset
+// estimates. It returns the bounds of that interval and whether it's agreed
+// on by a majority (more than half) of the intervals. Intervals whose low
+// bound exceeds their high bound agree with nothing.
+func IntersectIntervals(intervals [][2]time.Duration) (lo, hi time.Duration, ok bool) {
+	ivs := make([]interval, 0, len(intervals))
+	for _, iv := range intervals {
+		if iv[0] <= iv[1] {
+			ivs = append(ivs, interval{lo: iv[0], hi: iv[1]})
+		}
+	}
+	best, count := intersect(ivs)
+	if count*2 <= len(intervals) {
+		return 0, 0, false
+	}
+	return best.lo, best.hi, true
+}
+
+// truechimers returns the valid responses whose correctness intervals
+// overlap the interval agreed on by a majority of the valid responses. It
+// returns nil if no majority agrees.
+func truechimers(responses []*Response) []*Response {
+	var valid []*Response
+	var intervals []interval
+	for _, r := range responses {
+		if r == nil || r.Validate() != nil {
+			continue
+		}
+		valid = append(valid, r)
+		intervals = append(intervals, interval{
+			lo: r.ClockOffset - r.RootDistance,
+			hi: r.ClockOffset + r.RootDistance,
+		})
+	}
+
+	best, count := intersect(intervals)
+	if count*2 <= len(valid) {
+		return nil
+	}
+
+	var result []*Response
+	for i, r := range valid {
+		if intervals[i].lo <= best.hi && intervals[i].hi >= best.lo {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// An interval is a closed range of clock offsets.
+type interval struct {
+	lo, hi time.Duration
+}
+
+// intersect uses Marzullo's algorithm to find the smallest interval
+// contained by the largest number of the provided intervals. It returns the
+// interval and the number of intervals containing it.
+func intersect(intervals []interval) (best interval, count int) {
+	type edge struct {
+		t     time.Duration
+		start bool
+	}
+	edges := make([]edge, 0, 2*len(intervals))
+	for _, iv := range intervals {
+		edges = append(edges, edge{iv.lo, true}, edge{iv.hi, false})
+	}
+
+	// Sort the edges by offset. At equal offsets, start edges sort first
+	// so that intervals sharing an endpoint are treated as overlapping.
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].t != edges[j].t {
+			return edges[i].t < edges[j].t
+		}
+		return edges[i].start && !edges[j].start
+	})
+
+	n := 0
+	for i, e := range edges {
+		if !e.start {
+			n--
+			continue
+		}
+		n++
+		if n > count {
+			count = n
+			best = interval{lo: e.t, hi: edges[i+1].t}
+		}
+	}
+	return best, count
+}
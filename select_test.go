@@ -0,0 +1,134 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// responseAt returns a valid synthetic response with the given clock offset
+// and root distance.
+func responseAt(offset, dist time.Duration) *Response {
+	r := SyntheticResponse(offset)
+	r.RootDistance = dist
+	return r
+}
+
+func TestOfflineWeightedOffset(t *testing.T) {
+	kod := SyntheticResponse(0)
+	kod.Stratum = 0
+
+	responses := []*Response{
+		responseAt(10*time.Millisecond, 10*time.Millisecond),
+		responseAt(20*time.Millisecond, 20*time.Millisecond),
+		responseAt(500*time.Millisecond, 10*time.Millisecond), // falseticker
+		kod, // invalid
+		nil,
+	}
+
+	// The weights are 1/10ms and 1/20ms, so the first offset counts twice
+	// as much as the second: (2*10ms + 1*20ms) / 3.
+	assert.Equal(t, time.Duration(13333333), WeightedOffset(responses))
+
+	// Equal distances produce a plain average.
+	responses = []*Response{
+		responseAt(10*time.Millisecond, 50*time.Millisecond),
+		responseAt(30*time.Millisecond, 50*time.Millisecond),
+	}
+	assert.Equal(t, 20*time.Millisecond, WeightedOffset(responses))
+
+	// Without a majority, there's no estimate.
+	responses = []*Response{
+		responseAt(10*time.Millisecond, 5*time.Millisecond),
+		responseAt(30*time.Millisecond, 5*time.Millisecond),
+	}
+	assert.Equal(t, time.Duration(0), WeightedOffset(responses))
+	assert.Equal(t, time.Duration(0), WeightedOffset(nil))
+}
+
+func TestOfflineIntersect(t *testing.T) {
+	best, count := intersect([]interval{
+		{8, 12}, {11, 13}, {10, 12},
+	})
+	assert.Equal(t, interval{11, 12}, best)
+	assert.Equal(t, 3, count)
+
+	// Intervals sharing an endpoint overlap.
+	best, count = intersect([]interval{{0, 5}, {5, 10}, {20, 30}})
+	assert.Equal(t, interval{5, 5}, best)
+	assert.Equal(t, 2, count)
+
+	_, count = intersect(nil)
+	assert.Equal(t, 0, count)
+}
+
+func TestOfflineIntersectIntervals(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		intervals [][2]time.Duration
+		lo, hi    time.Duration
+		ok        bool
+	}{
+		// All intervals overlap.
+		{[][2]time.Duration{{8 * ms, 12 * ms}, {11 * ms, 13 * ms}, {10 * ms, 12 * ms}}, 11 * ms, 12 * ms, true},
+
+		// A majority clique of three outvotes a disjoint pair.
+		{[][2]time.Duration{{0, 10 * ms}, {5 * ms, 15 * ms}, {8 * ms, 20 * ms}, {100 * ms, 110 * ms}, {105 * ms, 120 * ms}}, 8 * ms, 10 * ms, true},
+
+		// Disjoint intervals have no majority.
+		{[][2]time.Duration{{0, 1 * ms}, {2 * ms, 3 * ms}, {4 * ms, 5 * ms}}, 0, 0, false},
+
+		// A tie isn't a majority.
+		{[][2]time.Duration{{0, 2 * ms}, {1 * ms, 3 * ms}, {10 * ms, 12 * ms}, {11 * ms, 13 * ms}}, 0, 0, false},
+
+		// A single interval agrees with itself.
+		{[][2]time.Duration{{-5 * ms, 5 * ms}}, -5 * ms, 5 * ms, true},
+
+		// Malformed intervals agree with nothing.
+		{[][2]time.Duration{{0, 10 * ms}, {2 * ms, 8 * ms}, {9 * ms, 1 * ms}}, 2 * ms, 8 * ms, true},
+		{[][2]time.Duration{{0, 10 * ms}, {9 * ms, 1 * ms}}, 0, 0, false},
+
+		{nil, 0, 0, false},
+	}
+	for i, c := range cases {
+		lo, hi, ok := IntersectIntervals(c.intervals)
+		assert.Equal(t, c.ok, ok, "case %d", i)
+		assert.Equal(t, c.lo, lo, "case %d", i)
+		assert.Equal(t, c.hi, hi, "case %d", i)
+	}
+}
+
+func TestOfflineSelectTruechimers(t *testing.T) {
+	// Four servers agree on an offset near 10ms. The fifth is a
+	// falseticker with the lowest stratum and RTT, so it must never be
+	// chosen.
+	a := responseAt(8*time.Millisecond, 5*time.Millisecond)
+	a.Stratum, a.RTT = 3, 20*time.Millisecond
+	b := responseAt(10*time.Millisecond, 5*time.Millisecond)
+	b.Stratum, b.RTT = 2, 40*time.Millisecond
+	c := responseAt(11*time.Millisecond, 5*time.Millisecond)
+	c.Stratum, c.RTT = 4, 10*time.Millisecond
+	d := responseAt(12*time.Millisecond, 4*time.Millisecond)
+	d.Stratum, d.RTT = 2, 30*time.Millisecond
+	f := responseAt(500*time.Millisecond, 5*time.Millisecond)
+	f.Stratum, f.RTT = 1, time.Millisecond
+	responses := []*Response{a, b, f, c, d}
+
+	// Stratum 2 is shared by b and d, and d has the lower distance.
+	assert.Equal(t, d, SelectTruechimers(responses, PolicyLowestStratum))
+	assert.Equal(t, c, SelectTruechimers(responses, PolicyLowestRTT))
+
+	// The median of 8, 10, 11 and 12ms is 10.5ms, equidistant from b and
+	// c, which have equal distances, so b is chosen as it appears first.
+	assert.Equal(t, b, SelectTruechimers(responses, PolicyClosestToMedian))
+
+	// Without a majority, nothing is selected.
+	assert.Nil(t, SelectTruechimers([]*Response{a, f}, PolicyLowestRTT))
+	assert.Nil(t, SelectTruechimers(nil, PolicyLowestStratum))
+	assert.Nil(t, SelectTruechimers(responses, SelectionPolicy(-1)))
+}
@@ -0,0 +1,19 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package ntp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setDontRoute enables the SO_DONTROUTE socket option on the raw
+// connection.
+func setDontRoute(rc syscall.RawConn) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,61 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ntp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inspectConn reads a socket option just before the connection is closed.
+type inspectConn struct {
+	*net.UDPConn
+	value int
+	err   error
+}
+
+func (c *inspectConn) Close() error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		c.err = err
+	} else {
+		rc.Control(func(fd uintptr) {
+			c.value, c.err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DONTROUTE)
+		})
+	}
+	return c.UDPConn.Close()
+}
+
+func TestOfflineDontRoute(t *testing.T) {
+	addr := startServer(t, func(q []byte) [][]byte {
+		return [][]byte{makeReply(q, nil)}
+	})
+
+	var con *inspectConn
+	opt := QueryOptions{
+		DontRoute: true,
+		Dialer: func(localAddress, remoteAddress string) (net.Conn, error) {
+			c, err := defaultDialer(localAddress, remoteAddress)
+			if err != nil {
+				return nil, err
+			}
+			con = &inspectConn{UDPConn: c.(*net.UDPConn)}
+			return con, nil
+		},
+	}
+
+	// The loopback server is directly reachable, so the query succeeds.
+	r, err := QueryWithOptions(addr.String(), opt)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	assert.Nil(t, con.err)
+	assert.NotEqual(t, 0, con.value)
+}
@@ -0,0 +1,23 @@
+// Copyright © 2015-2023 Brett Vickers.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package ntp
+
+import "syscall"
+
+// setDontRoute enables the SO_DONTROUTE socket option on the raw
+// connection.
+func setDontRoute(rc syscall.RawConn) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_DONTROUTE, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}